@@ -29,11 +29,13 @@ type PricesAmt struct {
 	graph    *graph.LabeledDirected
 
 	scheduler sched
+	exact     exact
 
 	cycles map[uint64]*model.Cycle
 
 	updateCh chan updateMsg
 	cycleCh  chan []*model.Cycle
+	rejectCh chan []*model.Cycle
 
 	returnThresh float64
 	metrics      *metrics.Metrics
@@ -58,6 +60,7 @@ func NewPrices(returnThreshs []float64, metrics *metrics.Metrics) *Prices {
 			},
 			updateCh:  make(chan updateMsg, 200),
 			cycleCh:   make(chan []*model.Cycle, 100),
+			rejectCh:  make(chan []*model.Cycle, 100),
 			scheduler: noopSched{},
 
 			returnThresh: returnThreshs[i],
@@ -78,6 +81,14 @@ func (p *Prices) SetScheduler(s sched) {
 	}
 }
 
+// SetExact makes new cycles go to the scheduler only if e confirms their
+// return, dropping those that exist due to float rounding only.
+func (p *Prices) SetExact(e exact) {
+	for _, a := range p.amts {
+		a.exact = e
+	}
+}
+
 func (p *Prices) Start(ctx context.Context, interval time.Duration, newCh chan struct{}) error {
 	eg, ctx := errgroup.WithContext(ctx)
 
@@ -156,7 +167,22 @@ func (p *Prices) Start(ctx context.Context, interval time.Duration, newCh chan s
 						continue
 					}
 
-					amt.scheduler.Add(added)
+					if amt.exact == nil {
+						amt.scheduler.Add(added)
+						continue
+					}
+
+					// the exact check reads the pools' reserves under their
+					// lock, which their updates hold while they send on
+					// updateCh: it must not run in this loop
+					go amt.confirm(added)
+
+				case cc := <-amt.rejectCh:
+					for _, c := range cc {
+						if amt.cycles[c.Hash()] == c {
+							delete(amt.cycles, c.Hash())
+						}
+					}
 
 				case <-updateTick.C:
 					amt.updateCycles()
@@ -242,6 +268,42 @@ func (p *PricesAmt) addCycle(cc ...*model.Cycle) []*model.Cycle {
 	return added
 }
 
+// confirm passes the new cycles the exact check confirms on to the
+// scheduler. The others are forgotten, so they are checked again when they
+// are found next.
+func (p *PricesAmt) confirm(cc []*model.Cycle) {
+	var ok, rejected []*model.Cycle
+
+	for _, c := range cc {
+		if p.exactOK(c) {
+			ok = append(ok, c)
+		} else {
+			rejected = append(rejected, c)
+		}
+	}
+
+	if len(rejected) > 0 {
+		p.rejectCh <- rejected
+	}
+	if len(ok) > 0 {
+		p.scheduler.Add(ok)
+	}
+}
+
+func (p *PricesAmt) exactOK(c *model.Cycle) bool {
+	if p.exact == nil {
+		return true
+	}
+
+	r, err := p.exact.Return(c)
+	ok := err == nil && r >= p.returnThresh
+	if p.metrics != nil {
+		p.metrics.MetricExact(p.amt, ok)
+	}
+
+	return ok
+}
+
 func (p *PricesAmt) vertexLookup() map[int32]common.Address {
 	v := map[int32]common.Address{}
 	for n, vv := range p.vertices {
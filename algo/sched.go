@@ -10,6 +10,12 @@ type sched interface {
 	Remove(cc map[uint64]struct{})
 }
 
+// exact works out the return of a cycle with the integer math of the pools,
+// see amm.Simulator.
+type exact interface {
+	Return(c *model.Cycle) (float64, error)
+}
+
 var _ sched = noopSched{}
 
 type noopSched struct{}
@@ -0,0 +1,160 @@
+package amm
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoPair      = errors.New("sim: no pair")
+	ErrNoLiquidity = errors.New("sim: insufficient liquidity")
+)
+
+// Hop is one swap of a simulated path.
+type Hop struct {
+	Pool     common.Address
+	AMM      model.AMM
+	TokenIn  common.Address
+	TokenOut common.Address
+
+	ReserveIn  *big.Int
+	ReserveOut *big.Int
+
+	AmountIn  *big.Int
+	AmountOut *big.Int
+}
+
+// Sim is the exact result of a cycle for one input amount.
+type Sim struct {
+	Hops      []Hop
+	AmountIn  *big.Int
+	AmountOut *big.Int
+	Profit    *big.Int
+}
+
+// Return is AmountOut over AmountIn.
+func (s *Sim) Return() float64 {
+	r, _ := new(big.Float).Quo(new(big.Float).SetInt(s.AmountOut), new(big.Float).SetInt(s.AmountIn)).Float64()
+	return r
+}
+
+// ReserveSource is an AMM that knows the current reserves of its pairs.
+type ReserveSource interface {
+	ID() model.AMM
+	Reserves(tokenIn, tokenOut common.Address) (pool common.Address, in, out *big.Int, ok bool)
+}
+
+// Simulator chains the swaps of a cycle with the integer math of the pair
+// contracts and the reserves last synced, which the float weights of the
+// graph only approximate.
+type Simulator struct {
+	amms map[model.AMM]ReserveSource
+}
+
+func NewSimulator(rr ...ReserveSource) *Simulator {
+	s := &Simulator{amms: make(map[model.AMM]ReserveSource)}
+	for _, r := range rr {
+		s.amms[r.ID()] = r
+	}
+	return s
+}
+
+// Simulate swaps amtIn of c's first token through the cycle. Hop i goes
+// from ParamAddrs[i] to ParamAddrs[i+1] on ParamAMMs[i+1], the last one back
+// to ParamAddrs[0] on ParamAMMs[0].
+func (s *Simulator) Simulate(c *model.Cycle, amtIn *big.Int) (*Sim, error) {
+	n := len(c.ParamAddrs)
+	if n < 2 || len(c.ParamAMMs) != n {
+		return nil, errors.New("sim: cycle has no params")
+	}
+
+	res := &Sim{AmountIn: new(big.Int).Set(amtIn)}
+	amt := res.AmountIn
+
+	for i := 0; i < n; i++ {
+		from, to, a := c.ParamAddrs[i], c.ParamAddrs[(i+1)%n], c.ParamAMMs[(i+1)%n]
+
+		src, ok := s.amms[a]
+		if !ok {
+			return nil, fmt.Errorf("sim: unknown amm %s", a)
+		}
+
+		pool, rIn, rOut, ok := src.Reserves(from, to)
+		if !ok {
+			return nil, errors.Wrap(ErrNoPair, fmt.Sprintf("%s %s->%s", a, from.Hex(), to.Hex()))
+		}
+
+		out, err := GetAmountOut(amt, rIn, rOut)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("hop %d", i))
+		}
+
+		res.Hops = append(res.Hops, Hop{
+			Pool:       pool,
+			AMM:        a,
+			TokenIn:    from,
+			TokenOut:   to,
+			ReserveIn:  rIn,
+			ReserveOut: rOut,
+			AmountIn:   amt,
+			AmountOut:  out,
+		})
+		amt = out
+	}
+
+	res.AmountOut = amt
+	res.Profit = new(big.Int).Sub(res.AmountOut, res.AmountIn)
+
+	return res, nil
+}
+
+// Return simulates c with its own amount, see Simulate.
+func (s *Simulator) Return(c *model.Cycle) (float64, error) {
+	res, err := s.Simulate(c, c.Amt.Int())
+	if err != nil {
+		return 0, err
+	}
+	return res.Return(), nil
+}
+
+// HopOuts is the output of every hop of c for its own amount. It implements
+// executor.Simulator.
+func (s *Simulator) HopOuts(c *model.Cycle) ([]*big.Int, error) {
+	res, err := s.Simulate(c, c.Amt.Int())
+	if err != nil {
+		return nil, err
+	}
+
+	outs := make([]*big.Int, len(res.Hops))
+	for i, h := range res.Hops {
+		outs[i] = h.AmountOut
+	}
+	return outs, nil
+}
+
+// GetAmountOut is UniswapV2Library.getAmountOut, a 0.3% fee included.
+func GetAmountOut(amtIn, reserveIn, reserveOut *big.Int) (*big.Int, error) {
+	if amtIn.Sign() <= 0 {
+		return nil, errors.New("sim: insufficient input amount")
+	}
+	if reserveIn.Sign() <= 0 || reserveOut.Sign() <= 0 {
+		return nil, ErrNoLiquidity
+	}
+
+	inWithFee := new(big.Int).Mul(amtIn, big.NewInt(997))
+	num := new(big.Int).Mul(inWithFee, reserveOut)
+	denom := new(big.Int).Mul(reserveIn, big.NewInt(1000))
+	denom.Add(denom, inWithFee)
+
+	out := num.Div(num, denom)
+	if out.Sign() == 0 {
+		return nil, errors.New("sim: insufficient output amount")
+	}
+
+	return out, nil
+}
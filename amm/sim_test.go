@@ -0,0 +1,124 @@
+package amm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+func e18(n int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e18))
+}
+
+func bigString(t *testing.T, s string) *big.Int {
+	t.Helper()
+	b, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		t.Fatal("bad number", s)
+	}
+	return b
+}
+
+// the swap test cases of UniswapV2Pair.spec.ts in v2-core: the most a pair
+// pays out for an input, one wei more fails its K check
+func TestGetAmountOut(t *testing.T) {
+	for _, tc := range []struct {
+		in, reserveIn, reserveOut int64
+		out                       string
+	}{
+		{1, 5, 10, "1662497915624478906"},
+		{1, 10, 5, "453305446940074565"},
+		{2, 5, 10, "2851015155847869602"},
+		{2, 10, 5, "831248957812239453"},
+		{1, 10, 10, "906610893880149131"},
+		{1, 100, 100, "987158034397061298"},
+		{1, 1000, 1000, "996006981039903216"},
+	} {
+		out, err := GetAmountOut(e18(tc.in), e18(tc.reserveIn), e18(tc.reserveOut))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bigString(t, tc.out); out.Cmp(want) != 0 {
+			t.Errorf("%d in, reserves %d/%d: out %s, want %s", tc.in, tc.reserveIn, tc.reserveOut, out, want)
+		}
+	}
+
+	if _, err := GetAmountOut(e18(1), new(big.Int), e18(1)); err != ErrNoLiquidity {
+		t.Errorf("empty reserve: %v", err)
+	}
+	if _, err := GetAmountOut(new(big.Int), e18(1), e18(1)); err == nil {
+		t.Error("zero input accepted")
+	}
+	if _, err := GetAmountOut(big.NewInt(1), e18(1000), big.NewInt(1)); err == nil {
+		t.Error("zero output accepted")
+	}
+}
+
+type pair struct {
+	pool   common.Address
+	t0, t1 common.Address
+	r0, r1 *big.Int
+}
+
+type fakeAMM struct {
+	id    model.AMM
+	pairs []pair
+}
+
+func (f *fakeAMM) ID() model.AMM { return f.id }
+
+func (f *fakeAMM) Reserves(tokenIn, tokenOut common.Address) (common.Address, *big.Int, *big.Int, bool) {
+	for _, p := range f.pairs {
+		switch {
+		case p.t0 == tokenIn && p.t1 == tokenOut:
+			return p.pool, p.r0, p.r1, true
+		case p.t1 == tokenIn && p.t0 == tokenOut:
+			return p.pool, p.r1, p.r0, true
+		}
+	}
+	return common.Address{}, nil, nil, false
+}
+
+func TestSimulate(t *testing.T) {
+	a := common.HexToAddress("0xa")
+
+	// 5 WETH / 10 A on both, the second hop swaps A in
+	uni := &fakeAMM{id: model.AMMUniswapV2, pairs: []pair{{pool: common.HexToAddress("0x1"), t0: model.WETHAddress, t1: a, r0: e18(5), r1: e18(10)}}}
+	sushi := &fakeAMM{id: model.AMMSushiswap, pairs: []pair{{pool: common.HexToAddress("0x2"), t0: a, t1: model.WETHAddress, r0: e18(5), r1: e18(10)}}}
+
+	c := model.NewCycle([]model.Half{{To: 0}, {To: 1}}, 1, model.AMT1, 0)
+	// hop i is on the amm of param i+1, the last one on the first
+	c.SetParams([]common.Address{model.WETHAddress, a}, []model.AMM{model.AMMSushiswap, model.AMMUniswapV2})
+
+	res, err := NewSimulator(uni, sushi).Simulate(c, c.Amt.Int())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Hops) != 2 {
+		t.Fatalf("%d hops", len(res.Hops))
+	}
+	if h := res.Hops[0]; h.Pool != common.HexToAddress("0x1") || h.AmountOut.Cmp(bigString(t, "1662497915624478906")) != 0 {
+		t.Errorf("hop 0 on %s out %s", h.Pool.Hex(), h.AmountOut)
+	}
+	if h := res.Hops[1]; h.Pool != common.HexToAddress("0x2") || h.AmountIn.Cmp(res.Hops[0].AmountOut) != 0 {
+		t.Errorf("hop 1 on %s in %s", h.Pool.Hex(), h.AmountIn)
+	}
+
+	want := bigString(t, "2489685057691792303")
+	if res.AmountOut.Cmp(want) != 0 {
+		t.Errorf("out %s, want %s", res.AmountOut, want)
+	}
+	if p := new(big.Int).Sub(want, e18(1)); res.Profit.Cmp(p) != 0 {
+		t.Errorf("profit %s, want %s", res.Profit, p)
+	}
+
+	uni.pairs = nil
+	if _, err := NewSimulator(uni, sushi).Simulate(c, c.Amt.Int()); errors.Cause(err) != ErrNoPair {
+		t.Errorf("missing pair: %v", err)
+	}
+}
@@ -391,6 +391,28 @@ func (s *Sushiswap) amtOut(amtIn *big.Int, addr, tokenIn common.Address) *big.In
 	return res
 }
 
+// Reserves returns the pair of tokenIn and tokenOut with its reserves in
+// that order, copies of the last synced ones. Pairs never synced are not
+// reported.
+func (s *Sushiswap) Reserves(tokenIn, tokenOut common.Address) (common.Address, *big.Int, *big.Int, bool) {
+	s.pairsLock.RLock()
+	defer s.pairsLock.RUnlock()
+
+	a, ok := s.pairToAddr[Pair{Token0: tokenIn, Token1: tokenOut}]
+	if !ok {
+		return common.Address{}, nil, nil, false
+	}
+	p := s.pairs[a]
+	if p.reserve0 == nil || p.reserve1 == nil {
+		return common.Address{}, nil, nil, false
+	}
+
+	if tokenIn == p.Token0.Address {
+		return a, new(big.Int).Set(p.reserve0), new(big.Int).Set(p.reserve1), true
+	}
+	return a, new(big.Int).Set(p.reserve1), new(big.Int).Set(p.reserve0), true
+}
+
 func (s *Sushiswap) GetPairAddress(ctx context.Context, t0, t1 common.Address) (common.Address, error) {
 	instance, err := sushiswap.NewUniswapV2Factory(sushiswapFactoryAddress, s.client)
 	if err != nil {
@@ -345,6 +345,28 @@ func (u *UniswapV2) amtOut(amtIn *big.Int, addr, tokenIn common.Address) (res *b
 	return res
 }
 
+// Reserves returns the pair of tokenIn and tokenOut with its reserves in
+// that order, copies of the last synced ones. Pairs never synced are not
+// reported.
+func (u *UniswapV2) Reserves(tokenIn, tokenOut common.Address) (common.Address, *big.Int, *big.Int, bool) {
+	u.pairsLock.RLock()
+	defer u.pairsLock.RUnlock()
+
+	a, ok := u.pairToAddr[Pair{Token0: tokenIn, Token1: tokenOut}]
+	if !ok {
+		return common.Address{}, nil, nil, false
+	}
+	p := u.pairs[a]
+	if p.reserve0 == nil || p.reserve1 == nil {
+		return common.Address{}, nil, nil, false
+	}
+
+	if tokenIn == p.Token0.Address {
+		return a, new(big.Int).Set(p.reserve0), new(big.Int).Set(p.reserve1), true
+	}
+	return a, new(big.Int).Set(p.reserve1), new(big.Int).Set(p.reserve0), true
+}
+
 func (u *UniswapV2) GetPairAddress(ctx context.Context, t0, t1 common.Address) (common.Address, error) {
 	instance, err := uniswapv2.NewUniswapV2Factory(uniV2FactoryAddress, u.client)
 	if err != nil {
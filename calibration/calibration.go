@@ -0,0 +1,284 @@
+// Package calibration compares the three estimates a cycle goes through:
+// the graph's return, the checker's simulation and, for live trades, what
+// the receipts show.
+package calibration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/tokens"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Keep is how long the record of a cycle without new estimates is kept.
+var Keep = time.Hour
+
+// Stages name which estimates an error compares, the later one less the
+// earlier one.
+const (
+	StageSimulated         = "simulated"
+	StageRealized          = "realized"
+	StageRealizedSimulated = "realized_simulated"
+)
+
+// Record holds the estimates of one cycle as returns, i.e. profit per unit
+// traded. Predicted is the graph's return when the cycle was last
+// simulated.
+type Record struct {
+	Hash   uint64           `json:"hash"`
+	Len    int              `json:"len"`
+	AMMs   string           `json:"amms"`
+	Tokens []common.Address `json:"tokens"`
+	Amt    float64          `json:"amt"`
+
+	Predicted float64  `json:"predicted"`
+	Simulated *float64 `json:"simulated,omitempty"`
+	Realized  *float64 `json:"realized,omitempty"`
+
+	Updated time.Time `json:"updated"`
+
+	amt model.AMT
+}
+
+// Stat sums up the errors of one stage in one breakdown.
+type Stat struct {
+	N       int     `json:"n"`
+	Mean    float64 `json:"mean"`
+	MeanAbs float64 `json:"mean_abs"`
+
+	sum, sumAbs float64
+}
+
+func (s *Stat) add(e float64) {
+	s.N++
+	s.sum += e
+	if e < 0 {
+		e = -e
+	}
+	s.sumAbs += e
+	s.Mean = s.sum / float64(s.N)
+	s.MeanAbs = s.sumAbs / float64(s.N)
+}
+
+// Calibration keeps the estimates per cycle hash and the errors between
+// them, as Prometheus histograms and as running stats served over http.
+type Calibration struct {
+	lock      sync.Mutex
+	records   map[uint64]*Record
+	stats     map[string]*Stat
+	lastPrune time.Time
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+func New(m *metrics.Metrics) *Calibration {
+	return &Calibration{
+		records:   make(map[uint64]*Record),
+		stats:     make(map[string]*Stat),
+		lastPrune: time.Now(),
+		metrics:   m,
+		log:       m.WithField("context", "Calibration"),
+	}
+}
+
+// Simulated records a successful check of c against the graph's return.
+func (cl *Calibration) Simulated(c *model.Cycle, res *model.RunResult) {
+	if res == nil || !res.Success || c.Amt.Float() == 0 {
+		return
+	}
+
+	sim := res.Return / c.Amt.Float()
+
+	cl.lock.Lock()
+	r := cl.record(c)
+	r.Predicted = c.Return - 1
+	r.Simulated = &sim
+	cl.observe(r, StageSimulated, sim-r.Predicted)
+	cl.lock.Unlock()
+}
+
+// Realized records the outcome of a live trade of c. gross is the WETH it
+// earned in eth before gas and coinbase payments, which is what the graph
+// and the checker estimate.
+func (cl *Calibration) Realized(c *model.Cycle, gross float64) {
+	if c.Amt.Float() == 0 {
+		return
+	}
+
+	real := gross / c.Amt.Float()
+
+	cl.lock.Lock()
+	r := cl.record(c)
+	r.Realized = &real
+	cl.observe(r, StageRealized, real-r.Predicted)
+	if r.Simulated != nil {
+		cl.observe(r, StageRealizedSimulated, real-*r.Simulated)
+	}
+	rr := *r
+	cl.lock.Unlock()
+
+	log := cl.log.WithField("hash", rr.Hash)
+	if rr.Simulated != nil {
+		log.Printf("return predicted %.5f simulated %.5f realized %.5f", rr.Predicted, *rr.Simulated, real)
+	} else {
+		log.Printf("return predicted %.5f realized %.5f", rr.Predicted, real)
+	}
+}
+
+// record returns the record of c, a new one with the graph's current
+// return if there is none.
+func (cl *Calibration) record(c *model.Cycle) *Record {
+	if time.Since(cl.lastPrune) > Keep/10 {
+		cl.prune()
+	}
+
+	r := cl.records[c.Hash()]
+	if r == nil {
+		r = &Record{
+			Hash:      c.Hash(),
+			Len:       len(c.ParamAMMs),
+			AMMs:      ammMix(c.ParamAMMs),
+			Tokens:    tokensOf(c),
+			Amt:       c.Amt.Float(),
+			amt:       c.Amt,
+			Predicted: c.Return - 1,
+		}
+		cl.records[c.Hash()] = r
+	}
+	r.Updated = time.Now()
+
+	return r
+}
+
+func (cl *Calibration) prune() {
+	for h, r := range cl.records {
+		if time.Since(r.Updated) > Keep {
+			delete(cl.records, h)
+		}
+	}
+	cl.lastPrune = time.Now()
+}
+
+func (cl *Calibration) observe(r *Record, stage string, e float64) {
+	classes := tokenClasses(r.Tokens)
+	cl.metrics.MetricCalibration(stage, r.Len, r.AMMs, r.amt, classes, e)
+
+	keys := []string{
+		stage,
+		stage + "/len=" + fmt.Sprint(r.Len),
+		stage + "/amms=" + r.AMMs,
+		stage + "/amt=" + fmt.Sprint(r.Amt),
+	}
+	for _, t := range classes {
+		keys = append(keys, stage+"/token="+t)
+	}
+
+	for _, k := range keys {
+		s := cl.stats[k]
+		if s == nil {
+			s = &Stat{}
+			cl.stats[k] = s
+		}
+		s.add(e)
+	}
+}
+
+// Record returns a copy of the record of the cycle with hash h.
+func (cl *Calibration) Record(h uint64) (Record, bool) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	r, ok := cl.records[h]
+	if !ok {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// Stats returns the error stats keyed by stage, alone or followed by one
+// breakdown, e.g. "simulated/len=3" or "realized/amms=SUSHI+UNIV2".
+func (cl *Calibration) Stats() map[string]Stat {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	out := make(map[string]Stat, len(cl.stats))
+	for k, s := range cl.stats {
+		out[k] = *s
+	}
+	return out
+}
+
+// ServeHTTP reports the stats, or with ?hash= the record of one cycle.
+func (cl *Calibration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if q := r.URL.Query().Get("hash"); q != "" {
+		var h uint64
+		if _, err := fmt.Sscan(q, &h); err != nil {
+			http.Error(w, "bad hash", http.StatusBadRequest)
+			return
+		}
+		rec, ok := cl.Record(h)
+		if !ok {
+			http.Error(w, "no record", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rec)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(cl.Stats())
+}
+
+// ammMix names the AMMs a cycle goes through, each once and sorted.
+func ammMix(aa []model.AMM) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, a := range aa {
+		if n := a.String(); !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "+")
+}
+
+// tokenClasses labels the errors of a cycle by token: trusted tokens by
+// address, every other one as "other", so labels and stats stay bounded.
+func tokenClasses(tt []common.Address) []string {
+	seen := make(map[string]bool)
+	var cc []string
+	for _, t := range tt {
+		c := "other"
+		if tokens.TrustedTokens[t] {
+			c = t.Hex()
+		}
+		if !seen[c] {
+			seen[c] = true
+			cc = append(cc, c)
+		}
+	}
+	return cc
+}
+
+func tokensOf(c *model.Cycle) []common.Address {
+	var tt []common.Address
+	for _, a := range c.ParamAddrs {
+		if a != model.WETHAddress {
+			tt = append(tt, a)
+		}
+	}
+	return tt
+}
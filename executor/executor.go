@@ -0,0 +1,303 @@
+// Package executor loads the definition of the on-chain arbitrage contract
+// and encodes a model.Cycle into calldata for it.
+//
+// A definition is a JSON file:
+//
+//	{
+//		"abi":     "executor.abi",
+//		"address": "0x...",
+//		"from":    "0x...",
+//		"method":  "swap",
+//		"args":    ["amt", "tokens", "dexes", "minOut"],
+//		"return":  0,
+//		"withdraw": "withdraw"
+//	}
+//
+// "abi" is resolved relative to the definition file. Each entry of "args"
+// names the source of the method input at the same position, see Sources.
+// "return" is the index of the output holding the profit in wei. The
+// optional "withdraw" method takes a token, a recipient and an amount and
+// sends the contract's balance out.
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+type Def struct {
+	ABI      string         `json:"abi"`
+	Address  common.Address `json:"address"`
+	From     common.Address `json:"from"`
+	Method   string         `json:"method"`
+	Args     []string       `json:"args"`
+	Return   int            `json:"return"`
+	Withdraw string         `json:"withdraw,omitempty"`
+}
+
+// Params are the values of a call that do not come from the cycle itself.
+// MinOuts are the least each hop may return, in hop order.
+type Params struct {
+	MinOut  *big.Int
+	MinOuts []*big.Int
+	Block   *big.Int
+	Bribe   *big.Int
+}
+
+type source func(c *model.Cycle, p *Params) interface{}
+
+// EncodeError is a cycle the definition cannot encode, a problem with the
+// configuration rather than with the trade.
+type EncodeError struct {
+	err error
+}
+
+func (e *EncodeError) Error() string { return e.err.Error() }
+func (e *EncodeError) Unwrap() error { return e.err }
+
+// IsEncode reports whether err, or any error it wraps, is an EncodeError.
+func IsEncode(err error) bool {
+	var e *EncodeError
+	return errors.As(err, &e)
+}
+
+var Sources = map[string]source{
+	"amt":     func(c *model.Cycle, _ *Params) interface{} { return c.Amt.Int() },
+	"tokens":  func(c *model.Cycle, _ *Params) interface{} { return c.ParamAddrs },
+	"dexes":   func(c *model.Cycle, _ *Params) interface{} { return model.AMMStoParams(c.ParamAMMs) },
+	"hash":    func(c *model.Cycle, _ *Params) interface{} { return new(big.Int).SetUint64(c.Hash()) },
+	"minOut":  func(c *model.Cycle, p *Params) interface{} { return orZero(p.MinOut) },
+	"minOuts": func(c *model.Cycle, p *Params) interface{} { return orZeros(p.MinOuts, len(c.ParamAddrs)) },
+	"block":   func(c *model.Cycle, p *Params) interface{} { return orZero(p.Block) },
+	"bribe":   func(c *model.Cycle, p *Params) interface{} { return orZero(p.Bribe) },
+}
+
+type Encoder struct {
+	Def
+	abi    abi.ABI
+	method abi.Method
+	sim    Simulator
+}
+
+func Load(file string) (*Encoder, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var d Def
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrap(err, "executor: def")
+	}
+
+	abiFile := d.ABI
+	if !filepath.IsAbs(abiFile) {
+		abiFile = filepath.Join(filepath.Dir(file), abiFile)
+	}
+
+	ab, err := ioutil.ReadFile(abiFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "executor: abi")
+	}
+
+	return New(d, ab)
+}
+
+func New(d Def, abiJSON []byte) (*Encoder, error) {
+	a, err := abi.JSON(bytes.NewReader(abiJSON))
+	if err != nil {
+		return nil, errors.Wrap(err, "executor: abi")
+	}
+
+	m, ok := a.Methods[d.Method]
+	if !ok {
+		return nil, fmt.Errorf("executor: method %q not in abi", d.Method)
+	}
+
+	if len(m.Inputs) != len(d.Args) {
+		return nil, fmt.Errorf("executor: %s has %d inputs, %d args mapped", d.Method, len(m.Inputs), len(d.Args))
+	}
+
+	for i, s := range d.Args {
+		if _, ok := Sources[s]; !ok {
+			return nil, fmt.Errorf("executor: arg %d: unknown source %q", i, s)
+		}
+	}
+
+	if d.Return < 0 || d.Return >= len(m.Outputs) {
+		return nil, fmt.Errorf("executor: %s has no output %d", d.Method, d.Return)
+	}
+
+	if d.Withdraw != "" {
+		w, ok := a.Methods[d.Withdraw]
+		if !ok {
+			return nil, fmt.Errorf("executor: method %q not in abi", d.Withdraw)
+		}
+		if len(w.Inputs) != 3 || w.Inputs[0].Type.T != abi.AddressTy || w.Inputs[1].Type.T != abi.AddressTy || w.Inputs[2].Type.T != abi.UintTy {
+			return nil, fmt.Errorf("executor: %s is not (address token, address to, uint amount)", d.Withdraw)
+		}
+	}
+
+	e := &Encoder{Def: d, abi: a, method: m}
+
+	// fail at startup rather than on the first cycle if a source does not
+	// fit the abi type of its input
+	dummy := model.NewCycle([]model.Half{{To: 0}}, 1, model.DefaultAMT, 0)
+	dummy.SetParams([]common.Address{model.WETHAddress}, []model.AMM{model.AMMUniswapV2})
+	if _, err := e.Pack(dummy, &Params{}); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Encoder) Pack(c *model.Cycle, p *Params) ([]byte, error) {
+	if p == nil {
+		p = &Params{}
+	}
+
+	pp := *p
+	if err := e.limits(c, &pp); err != nil {
+		return nil, errors.Wrap(err, "executor: limits")
+	}
+	p = &pp
+
+	args := make([]interface{}, len(e.Args))
+	for i, s := range e.Args {
+		v, err := convert(Sources[s](c, p), e.method.Inputs[i].Type)
+		if err != nil {
+			return nil, &EncodeError{errors.Wrap(err, fmt.Sprintf("executor: arg %d (%s)", i, s))}
+		}
+		args[i] = v
+	}
+
+	data, err := e.abi.Pack(e.Method, args...)
+	if err != nil {
+		return nil, &EncodeError{errors.Wrap(err, "executor: pack")}
+	}
+	return data, nil
+}
+
+// Has reports whether one of the method inputs is fed from source.
+func (e *Encoder) Has(source string) bool {
+	for _, s := range e.Args {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// PackWithdraw encodes a call sending amt of token held by the contract to
+// to. It fails if the definition has no withdraw method.
+func (e *Encoder) PackWithdraw(token, to common.Address, amt *big.Int) ([]byte, error) {
+	if e.Withdraw == "" {
+		return nil, errors.New("executor: no withdraw method")
+	}
+	return e.abi.Pack(e.Withdraw, token, to, amt)
+}
+
+// Unpack returns the profit output of the method in wei.
+func (e *Encoder) Unpack(out []byte) (*big.Int, error) {
+	res, err := e.abi.Unpack(e.Method, out)
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf(res[e.Return])
+	switch {
+	case v.Type() == reflect.TypeOf(&big.Int{}):
+		return v.Interface().(*big.Int), nil
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		return big.NewInt(v.Int()), nil
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64:
+		return new(big.Int).SetUint64(v.Uint()), nil
+	}
+
+	return nil, fmt.Errorf("executor: output %d is %s", e.Return, v.Type())
+}
+
+// convert turns the value of a source into the go type the abi package
+// expects for t, e.g. []*big.Int into []uint8 for a uint8[] input.
+func convert(v interface{}, t abi.Type) (interface{}, error) {
+	rt := t.GetType()
+	rv := reflect.ValueOf(v)
+
+	if rv.Type() == rt {
+		return v, nil
+	}
+
+	switch t.T {
+	case abi.SliceTy, abi.ArrayTy:
+		if rv.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("cannot use %s as %s", rv.Type(), t)
+		}
+		if t.T == abi.ArrayTy && rv.Len() > t.Size {
+			return nil, fmt.Errorf("%d elements do not fit %s", rv.Len(), t)
+		}
+
+		var out reflect.Value
+		if t.T == abi.SliceTy {
+			out = reflect.MakeSlice(rt, rv.Len(), rv.Len())
+		} else {
+			out = reflect.New(rt).Elem()
+		}
+
+		for i := 0; i < rv.Len(); i++ {
+			ev, err := convert(rv.Index(i).Interface(), *t.Elem)
+			if err != nil {
+				return nil, err
+			}
+			out.Index(i).Set(reflect.ValueOf(ev))
+		}
+		return out.Interface(), nil
+
+	case abi.UintTy, abi.IntTy:
+		b, ok := v.(*big.Int)
+		if !ok {
+			return nil, fmt.Errorf("cannot use %s as %s", rv.Type(), t)
+		}
+		if b.BitLen() > t.Size {
+			return nil, fmt.Errorf("%s overflows %s", b, t)
+		}
+
+		out := reflect.New(rt).Elem()
+		if t.T == abi.UintTy {
+			out.SetUint(b.Uint64())
+		} else {
+			out.SetInt(b.Int64())
+		}
+		return out.Interface(), nil
+	}
+
+	return nil, fmt.Errorf("cannot use %s as %s", rv.Type(), t)
+}
+
+func orZeros(bb []*big.Int, n int) []*big.Int {
+	if bb != nil {
+		return bb
+	}
+	z := make([]*big.Int, n)
+	for i := range z {
+		z[i] = new(big.Int)
+	}
+	return z
+}
+
+func orZero(b *big.Int) *big.Int {
+	if b == nil {
+		return new(big.Int)
+	}
+	return b
+}
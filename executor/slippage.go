@@ -0,0 +1,77 @@
+package executor
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+)
+
+var (
+	// Slippage is how much less than simulated each hop, and the cycle as a
+	// whole, may return before the executor reverts.
+	Slippage = 0.005
+
+	// MinProfit is the least the cycle has to return on top of its amount,
+	// in wei, whatever Slippage allows.
+	MinProfit = new(big.Int)
+
+	// SlippageReasons are revert reasons of executors and pairs that mean a
+	// minimum output was not met.
+	SlippageReasons = []string{"INSUFFICIENT_OUTPUT_AMOUNT", "minOut", "MIN_OUT", "slippage", "Slippage"}
+)
+
+// Simulator returns the exact output of every hop of c for c.Amt, in hop
+// order, see amm.Simulator.
+type Simulator interface {
+	HopOuts(c *model.Cycle) ([]*big.Int, error)
+}
+
+// SetSimulator makes Pack fill in the minOut and minOuts sources from sim
+// when the caller left them out. Historic calls, with a Block, are not
+// limited: sim only knows the current reserves.
+func (e *Encoder) SetSimulator(sim Simulator) {
+	e.sim = sim
+}
+
+// limits sets p.MinOuts to the exact hop outputs less Slippage and p.MinOut
+// to the last of them, but at least the amount plus MinProfit.
+func (e *Encoder) limits(c *model.Cycle, p *Params) error {
+	if e.sim == nil || p.Block != nil || p.MinOut != nil || p.MinOuts != nil || !e.Has("minOut") && !e.Has("minOuts") {
+		return nil
+	}
+
+	outs, err := e.sim.HopOuts(c)
+	if err != nil {
+		return err
+	}
+
+	keep := big.NewInt(int64((1 - Slippage) * 1e6))
+	p.MinOuts = make([]*big.Int, len(outs))
+	for i, o := range outs {
+		p.MinOuts[i] = new(big.Int).Div(new(big.Int).Mul(o, keep), big.NewInt(1e6))
+	}
+
+	p.MinOut = new(big.Int).Add(c.Amt.Int(), MinProfit)
+	if last := p.MinOuts[len(p.MinOuts)-1]; last.Cmp(p.MinOut) > 0 {
+		p.MinOut = last
+	}
+
+	return nil
+}
+
+// IsSlippage reports whether err is a revert over a minimum output, which
+// is down to reserves moving rather than to the cycle.
+func IsSlippage(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	s := err.Error()
+	for _, r := range SlippageReasons {
+		if strings.Contains(s, r) {
+			return true
+		}
+	}
+	return false
+}
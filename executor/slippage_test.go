@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type hopOuts []*big.Int
+
+func (h hopOuts) HopOuts(c *model.Cycle) ([]*big.Int, error) { return h, nil }
+
+func ints(ns ...int64) []*big.Int {
+	b := make([]*big.Int, len(ns))
+	for i, n := range ns {
+		b[i] = big.NewInt(n)
+	}
+	return b
+}
+
+func TestLimits(t *testing.T) {
+	defer func(s float64, m *big.Int) { Slippage, MinProfit = s, m }(Slippage, MinProfit)
+
+	c := model.NewCycle([]model.Half{{To: 0}, {To: 1}}, 1.01, model.AMT1, 0)
+	c.SetParams([]common.Address{model.WETHAddress, common.HexToAddress("0xa")}, []model.AMM{model.AMMSushiswap, model.AMMUniswapV2})
+	amt := c.Amt.Int()
+
+	plus := func(n int64) *big.Int { return new(big.Int).Add(amt, big.NewInt(n)) }
+	over := new(big.Int).Mul(amt, big.NewInt(2))
+
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		sim       Simulator
+		slippage  float64
+		minProfit int64
+		p         Params
+
+		minOut  *big.Int
+		minOuts []*big.Int
+	}{
+		{"no simulator", []string{"minOut", "minOuts"}, nil, 0.01, 0, Params{}, nil, nil},
+		{"no minimum args", []string{"amt", "tokens"}, hopOuts{big.NewInt(1), over}, 0.01, 0, Params{}, nil, nil},
+		{"historic", []string{"minOut"}, hopOuts{big.NewInt(1), over}, 0.01, 0, Params{Block: big.NewInt(1)}, nil, nil},
+		{"min out set", []string{"minOut"}, hopOuts{big.NewInt(1), over}, 0.01, 0, Params{MinOut: big.NewInt(7)}, big.NewInt(7), nil},
+		{"min outs set", []string{"minOuts"}, hopOuts{big.NewInt(1), over}, 0.01, 0, Params{MinOuts: ints(3, 4)}, nil, ints(3, 4)},
+		{"slippage", []string{"minOuts"}, hopOuts{big.NewInt(1000), over}, 0.01, 0, Params{},
+			new(big.Int).Div(new(big.Int).Mul(over, big.NewInt(990000)), big.NewInt(1e6)),
+			[]*big.Int{big.NewInt(990), new(big.Int).Div(new(big.Int).Mul(over, big.NewInt(990000)), big.NewInt(1e6))}},
+		{"rounded down", []string{"minOut"}, hopOuts{big.NewInt(999), over}, 0.005, 0, Params{},
+			new(big.Int).Div(new(big.Int).Mul(over, big.NewInt(995000)), big.NewInt(1e6)),
+			[]*big.Int{big.NewInt(994), new(big.Int).Div(new(big.Int).Mul(over, big.NewInt(995000)), big.NewInt(1e6))}},
+		{"at least the amount", []string{"minOut"}, hopOuts{big.NewInt(1000), plus(10)}, 0.01, 0, Params{},
+			amt, []*big.Int{big.NewInt(990), new(big.Int).Div(new(big.Int).Mul(plus(10), big.NewInt(990000)), big.NewInt(1e6))}},
+		{"at least min profit", []string{"minOut"}, hopOuts{big.NewInt(1000), over}, 0.01, 1e18, Params{},
+			new(big.Int).Add(amt, big.NewInt(1e18)), []*big.Int{big.NewInt(990), new(big.Int).Div(new(big.Int).Mul(over, big.NewInt(990000)), big.NewInt(1e6))}},
+	} {
+		Slippage, MinProfit = tc.slippage, big.NewInt(tc.minProfit)
+		e := &Encoder{Def: Def{Args: tc.args}, sim: tc.sim}
+
+		p := tc.p
+		if err := e.limits(c, &p); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if !eq(p.MinOut, tc.minOut) {
+			t.Errorf("%s: min out %s, want %s", tc.name, p.MinOut, tc.minOut)
+		}
+		if len(p.MinOuts) != len(tc.minOuts) {
+			t.Fatalf("%s: min outs %v, want %v", tc.name, p.MinOuts, tc.minOuts)
+		}
+		for i := range p.MinOuts {
+			if !eq(p.MinOuts[i], tc.minOuts[i]) {
+				t.Errorf("%s: min outs[%d] %s, want %s", tc.name, i, p.MinOuts[i], tc.minOuts[i])
+			}
+		}
+	}
+}
+
+type failing struct{}
+
+func (failing) HopOuts(c *model.Cycle) ([]*big.Int, error) { return nil, errors.New("no reserves") }
+
+func TestLimitsError(t *testing.T) {
+	c := model.NewCycle([]model.Half{{To: 0}}, 1.01, model.AMT1, 0)
+	c.SetParams([]common.Address{model.WETHAddress}, []model.AMM{model.AMMUniswapV2})
+
+	e := &Encoder{Def: Def{Args: []string{"minOut"}}, sim: failing{}}
+	if err := e.limits(c, &Params{}); err == nil {
+		t.Error("simulator error swallowed")
+	}
+}
+
+func eq(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
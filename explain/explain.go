@@ -0,0 +1,224 @@
+// Package explain breaks a cycle down hop by hop, with token symbols,
+// pools, reserves, amounts and costs, for people to read.
+package explain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/amm"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/tokens"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// FeeBps is the swap fee of the pools, 0.3%.
+const FeeBps = 30
+
+type Token struct {
+	Address  common.Address `json:"address"`
+	Symbol   string         `json:"symbol"`
+	Decimals int            `json:"decimals"`
+}
+
+// Hop amounts are in whole tokens. PriceImpact is how much worse than the
+// pool's mid price, fee aside, the swap is filled; Fee is in TokenIn.
+type Hop struct {
+	Pool     common.Address `json:"pool"`
+	AMM      string         `json:"amm"`
+	TokenIn  Token          `json:"token_in"`
+	TokenOut Token          `json:"token_out"`
+
+	ReserveIn  float64 `json:"reserve_in"`
+	ReserveOut float64 `json:"reserve_out"`
+	AmountIn   float64 `json:"amount_in"`
+	AmountOut  float64 `json:"amount_out"`
+
+	PriceImpact float64 `json:"price_impact"`
+	Fee         float64 `json:"fee"`
+}
+
+// Explanation is a cycle simulated against the reserves last synced.
+// Profits are in eth, Return is the graph's.
+type Explanation struct {
+	Hash   uint64  `json:"hash"`
+	Amt    float64 `json:"amt"`
+	Return float64 `json:"return"`
+	Hops   []Hop   `json:"hops"`
+
+	Gross    float64 `json:"gross"`
+	GasUsed  uint64  `json:"gas_used,omitempty"`
+	GasPrice float64 `json:"gas_price_gwei,omitempty"`
+	GasCost  float64 `json:"gas_cost"`
+	Net      float64 `json:"net"`
+
+	// Simulated is the checker's profit, if the cycle was checked.
+	Simulated *float64 `json:"simulated,omitempty"`
+}
+
+// Explainer explains cycles with the reserves known to sim and the token
+// metadata of tl. Gas is priced at the node's suggestion, read at most once
+// a block.
+type Explainer struct {
+	sim *amm.Simulator
+	tl  *tokens.List
+	c   *ethclient.Client
+
+	lock     sync.Mutex
+	gasPrice *big.Int
+	gasAt    time.Time
+}
+
+func New(c *ethclient.Client, sim *amm.Simulator, tl *tokens.List) *Explainer {
+	return &Explainer{sim: sim, tl: tl, c: c}
+}
+
+func (e *Explainer) Explain(c *model.Cycle) (*Explanation, error) {
+	res, err := e.sim.Simulate(c, c.Amt.Int())
+	if err != nil {
+		return nil, err
+	}
+
+	x := &Explanation{
+		Hash:   c.Hash(),
+		Amt:    c.Amt.Float(),
+		Return: c.Return,
+		Gross:  weiToEth(res.Profit),
+	}
+
+	for _, h := range res.Hops {
+		in, out := e.token(h.TokenIn), e.token(h.TokenOut)
+
+		// mid price out per in, and what the swap paid once the fee is
+		// taken off the input
+		mid := ratio(h.ReserveOut, h.ReserveIn)
+		paid := ratio(h.AmountOut, new(big.Int).Div(new(big.Int).Mul(h.AmountIn, big.NewInt(10000-FeeBps)), big.NewInt(10000)))
+
+		x.Hops = append(x.Hops, Hop{
+			Pool:        h.Pool,
+			AMM:         h.AMM.String(),
+			TokenIn:     in,
+			TokenOut:    out,
+			ReserveIn:   units(h.ReserveIn, in.Decimals),
+			ReserveOut:  units(h.ReserveOut, out.Decimals),
+			AmountIn:    units(h.AmountIn, in.Decimals),
+			AmountOut:   units(h.AmountOut, out.Decimals),
+			PriceImpact: 1 - paid/mid,
+			Fee:         units(h.AmountIn, in.Decimals) * FeeBps / 10000,
+		})
+	}
+
+	if c.TestRes != nil && c.TestRes.Success {
+		sim := c.TestRes.Return
+		x.Simulated = &sim
+		x.GasUsed = c.TestRes.GasUsed
+	}
+
+	x.Net = x.Gross
+	if gp := e.price(); gp != nil && x.GasUsed > 0 {
+		cost := new(big.Int).Mul(gp, new(big.Int).SetUint64(x.GasUsed))
+		x.GasPrice = weiToEth(gp) * 1e9
+		x.GasCost = weiToEth(cost)
+		x.Net -= x.GasCost
+	}
+
+	return x, nil
+}
+
+// Text is the explanation of c for logs, or why there is none.
+func (e *Explainer) Text(c *model.Cycle) string {
+	x, err := e.Explain(c)
+	if err != nil {
+		return fmt.Sprintf("cycle %d: %s\n%v\n%v", c.Hash(), err, c.ParamAddrs, c.ParamAMMs)
+	}
+	return x.Text()
+}
+
+// JSON is the explanation of c, nil if there is none.
+func (e *Explainer) JSON(c *model.Cycle) json.RawMessage {
+	x, err := e.Explain(c)
+	if err != nil {
+		return nil
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (x *Explanation) Text() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "cycle %d amt %.1f return %.5f\n", x.Hash, x.Amt, x.Return)
+	for i, h := range x.Hops {
+		fmt.Fprintf(&b, "%2d. %s -> %s on %s %s\n", i+1, h.TokenIn.Symbol, h.TokenOut.Symbol, h.AMM, h.Pool.Hex())
+		fmt.Fprintf(&b, "    in %.6g out %.6g reserves %.6g / %.6g impact %.3f%% fee %.6g %s\n",
+			h.AmountIn, h.AmountOut, h.ReserveIn, h.ReserveOut, h.PriceImpact*100, h.Fee, h.TokenIn.Symbol)
+	}
+
+	fmt.Fprintf(&b, "gross %.6f", x.Gross)
+	if x.GasUsed > 0 {
+		fmt.Fprintf(&b, " gas %d @ %.1f gwei = %.6f", x.GasUsed, x.GasPrice, x.GasCost)
+	}
+	fmt.Fprintf(&b, " net %.6f", x.Net)
+	if x.Simulated != nil {
+		fmt.Fprintf(&b, " simulated %.6f", *x.Simulated)
+	}
+
+	return b.String()
+}
+
+func (e *Explainer) token(a common.Address) Token {
+	t := Token{Address: a, Symbol: a.Hex()[:8], Decimals: 18}
+	if tt := e.tl.ByAddr(a); tt != nil {
+		t.Symbol, t.Decimals = tt.Symbol, tt.Decimals
+	}
+	return t
+}
+
+// price is the suggested gas price, nil if the node has none.
+func (e *Explainer) price() *big.Int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.gasPrice != nil && time.Since(e.gasAt) < 12*time.Second {
+		return e.gasPrice
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	gp, err := e.c.SuggestGasPrice(ctx)
+	if err != nil {
+		return e.gasPrice
+	}
+	e.gasPrice, e.gasAt = gp, time.Now()
+
+	return gp
+}
+
+func ratio(a, b *big.Int) float64 {
+	if b.Sign() == 0 {
+		return 0
+	}
+	r, _ := new(big.Float).Quo(new(big.Float).SetInt(a), new(big.Float).SetInt(b)).Float64()
+	return r
+}
+
+func units(b *big.Int, dec int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(b), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(dec)), nil))).Float64()
+	return f
+}
+
+func weiToEth(w *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(w), big.NewFloat(1e18)).Float64()
+	return f
+}
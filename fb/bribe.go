@@ -0,0 +1,139 @@
+package fb
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+)
+
+type BribeMode int
+
+const (
+	// BribeCoinbase passes the payment to the executor, which transfers it
+	// to block.coinbase.
+	BribeCoinbase BribeMode = iota
+	// BribePriorityFee spreads the payment over the gas limit as tip.
+	BribePriorityFee
+)
+
+func (m BribeMode) String() string {
+	if m == BribePriorityFee {
+		return "priority_fee"
+	}
+	return "coinbase"
+}
+
+// Bribe decides what share of a cycle's simulated profit goes to the block
+// builder. It walks the share down after inclusions and up after misses so
+// it settles at the lowest share that still gets bundles included. There is
+// one share for all target blocks, each outcome moves it.
+type Bribe struct {
+	lock sync.Mutex
+
+	Mode     BribeMode
+	Min, Max float64
+	Step     float64
+
+	share          float64
+	lowestIncluded float64
+
+	metrics *metrics.Metrics
+}
+
+type BribeDecision struct {
+	Share  float64
+	Profit *big.Int
+	Amount *big.Int
+	Mode   BribeMode
+}
+
+func NewBribe(mode BribeMode, start float64, m *metrics.Metrics) *Bribe {
+	return &Bribe{
+		Mode:    mode,
+		Min:     0.05,
+		Max:     0.95,
+		Step:    0.025,
+		share:   start,
+		metrics: m,
+	}
+}
+
+func (b *Bribe) Share() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.share
+}
+
+// Decide returns the payment for a bundle with the given simulated profit in
+// wei.
+func (b *Bribe) Decide(profit *big.Int) *BribeDecision {
+	b.lock.Lock()
+	share := b.share
+	b.lock.Unlock()
+
+	amt, _ := new(big.Float).Mul(new(big.Float).SetInt(profit), big.NewFloat(share)).Int(nil)
+
+	d := &BribeDecision{
+		Share:  share,
+		Profit: profit,
+		Amount: amt,
+		Mode:   b.Mode,
+	}
+
+	b.metrics.MetricBribe(b.Mode.String(), share, weiToEth(amt))
+
+	return d
+}
+
+// Outcome feeds back whether the bundle carrying d landed in its target block.
+func (b *Bribe) Outcome(d *BribeDecision, included bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if included {
+		if b.lowestIncluded == 0 || d.Share < b.lowestIncluded {
+			b.lowestIncluded = d.Share
+		}
+		if d.Share-b.Step < b.share {
+			b.share = d.Share - b.Step
+		}
+	} else if d.Share+b.Step > b.share {
+		b.share = d.Share + b.Step
+	}
+
+	if b.share < b.Min {
+		b.share = b.Min
+	}
+	if b.share > b.Max {
+		b.share = b.Max
+	}
+
+	b.metrics.MetricBribeOutcome(d.Mode.String(), included, b.share, b.lowestIncluded)
+}
+
+// coinbase is the amount the executor should transfer to the builder.
+func (d *BribeDecision) coinbase() *big.Int {
+	if d == nil || d.Mode != BribeCoinbase {
+		return nil
+	}
+	return d.Amount
+}
+
+// tip is the priority fee per gas that pays d over gas units.
+func (d *BribeDecision) tip(gas uint64) *big.Int {
+	if d == nil || d.Mode != BribePriorityFee || gas == 0 {
+		return nil
+	}
+	return new(big.Int).Div(d.Amount, new(big.Int).SetUint64(gas))
+}
+
+func ethToWei(f float64) *big.Int {
+	w, _ := new(big.Float).Mul(big.NewFloat(f), big.NewFloat(1e+18)).Int(nil)
+	return w
+}
+
+func weiToEth(w *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(w), big.NewFloat(1e+18)).Float64()
+	return f
+}
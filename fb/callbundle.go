@@ -0,0 +1,145 @@
+package fb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// MinProfit is the lowest simulated profit in wei, after bribe and gas, for
+// which a bundle is still sent.
+var MinProfit = new(big.Int)
+
+var (
+	ErrSimReverted = errors.New("bundle simulation reverted")
+	ErrSimNoProfit = errors.New("bundle simulation below min profit")
+)
+
+type BundleCallResElem struct {
+	CoinbaseDiff      string `json:"coinbaseDiff"`
+	EthSentToCoinbase string `json:"ethSentToCoinbase"`
+	GasFees           string `json:"gasFees"`
+	GasPrice          string `json:"gasPrice"`
+	GasUsed           uint64 `json:"gasUsed"`
+	TxHash            string `json:"txHash"`
+	Value             string `json:"value"`
+	Error             string `json:"error"`
+	Revert            string `json:"revert"`
+}
+
+type BundleCallRes struct {
+	BundleGasPrice    string              `json:"bundleGasPrice"`
+	BundleHash        string              `json:"bundleHash"`
+	CoinbaseDiff      string              `json:"coinbaseDiff"`
+	EthSentToCoinbase string              `json:"ethSentToCoinbase"`
+	GasFees           string              `json:"gasFees"`
+	StateBlockNumber  uint64              `json:"stateBlockNumber"`
+	TotalGasUsed      uint64              `json:"totalGasUsed"`
+	Results           []BundleCallResElem `json:"results"`
+}
+
+// callBundle simulates txs as the content of targetBlock on top of the state
+// after stateBlock.
+func (m *MEV) callBundle(ctx context.Context, txs []*types.Transaction, targetBlock, stateBlock uint64) (*BundleCallRes, error) {
+	var raw []string
+	for _, tx := range txs {
+		txbb, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, hexutil.Bytes(txbb).String())
+	}
+
+	br := &bundleRequest{
+		Method: "eth_callBundle",
+		Params: []interface{}{
+			raw,
+			fmt.Sprintf("0x%x", targetBlock),
+			fmt.Sprintf("0x%x", stateBlock),
+		},
+		ID:      m.nextID(),
+		JsonRPC: "2.0",
+	}
+
+	res, err := m.call(ctx, br)
+	if err != nil {
+		return nil, err
+	}
+
+	var r BundleCallRes
+	if err := json.Unmarshal(res, &r); err != nil {
+		return nil, errors.Wrap(err, "eth_callBundle result")
+	}
+
+	if len(r.Results) != len(txs) {
+		return nil, fmt.Errorf("eth_callBundle: %d results for %d txs", len(r.Results), len(txs))
+	}
+
+	return &r, nil
+}
+
+// bundleSim turns the relay's answer into a model.BundleSim. The profit of
+// the bundle is read by unpack from the return value of the last tx; base
+// fee burnt and everything paid to the coinbase is subtracted from it.
+func bundleSim(r *BundleCallRes, stateBlock uint64, baseFee *big.Int, fallback *big.Int, unpack func([]byte) (*big.Int, error)) *model.BundleSim {
+	s := &model.BundleSim{
+		StateBlock:   stateBlock,
+		GasUsed:      r.TotalGasUsed,
+		CoinbaseDiff: parseWei(r.CoinbaseDiff),
+		GasFees:      parseWei(r.GasFees),
+	}
+
+	for _, t := range r.Results {
+		if r.TotalGasUsed == 0 {
+			s.GasUsed += t.GasUsed
+		}
+
+		if t.Error != "" || t.Revert != "" {
+			s.Reverted = true
+			s.Errors = append(s.Errors, fmt.Sprintf("%s: %s %s", t.TxHash, t.Error, t.Revert))
+		}
+	}
+
+	s.Profit = fallback
+	if last := r.Results[len(r.Results)-1]; !s.Reverted && last.Value != "" {
+		if out, err := hexutil.Decode(last.Value); err == nil {
+			if p, err := unpack(out); err == nil {
+				s.Profit = p
+			}
+		}
+	}
+
+	s.NetProfit = new(big.Int).Sub(s.Profit, s.CoinbaseDiff)
+	if baseFee != nil {
+		s.NetProfit.Sub(s.NetProfit, new(big.Int).Mul(baseFee, new(big.Int).SetUint64(s.GasUsed)))
+	}
+
+	return s
+}
+
+func checkSim(s *model.BundleSim, min *big.Int) error {
+	if s.Reverted {
+		return errors.Wrap(ErrSimReverted, fmt.Sprint(s.Errors))
+	}
+
+	if min != nil && s.NetProfit.Cmp(min) < 0 {
+		return errors.Wrap(ErrSimNoProfit, fmt.Sprintf("net %s wei, min %s wei", s.NetProfit, min))
+	}
+
+	return nil
+}
+
+func parseWei(s string) *big.Int {
+	b, ok := new(big.Int).SetString(s, 0)
+	if !ok {
+		return new(big.Int)
+	}
+	return b
+}
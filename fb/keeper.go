@@ -0,0 +1,359 @@
+package fb
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/signer"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoKeeper = errors.New("no idle keeper")
+
+	// StuckAfter is how long a keeper may have pending txs that are not
+	// mined before it is considered stuck and a replacement is sent.
+	StuckAfter = 3 * time.Minute
+)
+
+type Keeper struct {
+	Addr   common.Address
+	signer signer.Signer
+
+	nonce uint64
+	busy  bool
+
+	stuck        bool
+	pendingSince time.Time
+
+	// signed holds the highest priced tx signed for each nonce not known to
+	// be mined, a replacement has to outbid it.
+	signedLock sync.Mutex
+	signed     map[uint64]*types.Transaction
+}
+
+func (k *Keeper) Nonce() uint64 {
+	return k.nonce
+}
+
+// signTx signs tx and remembers it as signed for its nonce.
+func (k *Keeper) signTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	stx, err := k.signer.SignTx(tx, chainID)
+	if err != nil {
+		return nil, err
+	}
+
+	k.signedLock.Lock()
+	if k.signed == nil {
+		k.signed = make(map[uint64]*types.Transaction)
+	}
+	if prev := k.signed[stx.Nonce()]; prev == nil || stx.GasFeeCap().Cmp(prev.GasFeeCap()) > 0 {
+		k.signed[stx.Nonce()] = stx
+	}
+	k.signedLock.Unlock()
+
+	return stx, nil
+}
+
+// signedAt returns the highest priced tx signed for nonce.
+func (k *Keeper) signedAt(nonce uint64) *types.Transaction {
+	k.signedLock.Lock()
+	defer k.signedLock.Unlock()
+	return k.signed[nonce]
+}
+
+// forget drops the txs signed for nonces below latest, they are mined.
+func (k *Keeper) forget(latest uint64) {
+	k.signedLock.Lock()
+	for n := range k.signed {
+		if n < latest {
+			delete(k.signed, n)
+		}
+	}
+	k.signedLock.Unlock()
+}
+
+// Keepers is a pool of keeper accounts. Each keeper carries its own locally
+// tracked nonce and is lent to at most one submission at a time.
+type Keepers struct {
+	lock sync.Mutex
+	kk   []*Keeper
+	next int
+
+	c   *ethclient.Client
+	log logrus.FieldLogger
+}
+
+func NewKeepers(c *ethclient.Client, log logrus.FieldLogger, specs ...string) (*Keepers, error) {
+	p := &Keepers{c: c, log: log}
+
+	for _, spec := range specs {
+		s, err := signer.Open(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, "keeper "+spec)
+		}
+
+		p.kk = append(p.kk, &Keeper{Addr: s.Address(), signer: s})
+	}
+
+	if len(p.kk) == 0 {
+		return nil, errors.New("no keepers")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, k := range p.kk {
+		n, err := c.NonceAt(ctx, k.Addr, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "nonce "+k.Addr.Hex())
+		}
+		k.nonce = n
+	}
+
+	return p, nil
+}
+
+func (p *Keepers) Len() int {
+	return len(p.kk)
+}
+
+func (p *Keepers) Idle() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n := 0
+	for _, k := range p.kk {
+		if !k.busy && !k.stuck {
+			n++
+		}
+	}
+	return n
+}
+
+// Acquire lends out the next idle keeper, round robin.
+func (p *Keepers) Acquire() (*Keeper, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := range p.kk {
+		k := p.kk[(p.next+i)%len(p.kk)]
+		if k.busy || k.stuck {
+			continue
+		}
+
+		k.busy = true
+		p.next = (p.next + i + 1) % len(p.kk)
+		return k, nil
+	}
+
+	return nil, ErrNoKeeper
+}
+
+// AcquireAddr lends out the keeper with address a if it is idle.
+func (p *Keepers) AcquireAddr(a common.Address) (*Keeper, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, k := range p.kk {
+		if k.Addr == a && !k.busy && !k.stuck {
+			k.busy = true
+			return k, nil
+		}
+	}
+
+	return nil, ErrNoKeeper
+}
+
+// Addrs lists the keeper accounts.
+func (p *Keepers) Addrs() []common.Address {
+	aa := make([]common.Address, len(p.kk))
+	for i, k := range p.kk {
+		aa[i] = k.Addr
+	}
+	return aa
+}
+
+// Release returns k to the pool. included reports whether the tx sent with
+// k's current nonce made it on chain.
+func (p *Keepers) Release(k *Keeper, included bool) {
+	if included {
+		p.ReleaseN(k, 1)
+	} else {
+		p.ReleaseN(k, 0)
+	}
+}
+
+// ReleaseN returns k to the pool after used of its nonces made it on chain.
+func (p *Keepers) ReleaseN(k *Keeper, used uint64) {
+	p.lock.Lock()
+	k.nonce += used
+	k.busy = false
+	p.lock.Unlock()
+}
+
+func (p *Keepers) Start(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			for _, k := range p.kk {
+				if err := p.reconcile(ctx, k); err != nil {
+					p.log.WithError(err).WithField("keeper", k.Addr.Hex()).Error("reconcile")
+				}
+			}
+		}
+	}
+}
+
+// reconcile compares the local nonce of an idle keeper against the latest
+// and pending chain state: nonces used elsewhere are skipped, gaps are
+// closed, and accounts with txs stuck in the mempool get a replacement.
+func (p *Keepers) reconcile(ctx context.Context, k *Keeper) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	latest, err := p.c.NonceAt(ctx, k.Addr, nil)
+	if err != nil {
+		return err
+	}
+
+	pending, err := p.c.PendingNonceAt(ctx, k.Addr)
+	if err != nil {
+		return err
+	}
+
+	k.forget(latest)
+
+	// unstick calls the node and the signer, Idle and Acquire must not wait
+	// on them
+	if !p.update(k, latest, pending) {
+		return nil
+	}
+
+	return p.unstick(ctx, k, latest)
+}
+
+// update brings the nonce of k in line with the chain and reports whether
+// k is stuck. Stuck keepers are not lent out, so k may be used unlocked
+// while it stays stuck.
+func (p *Keepers) update(k *Keeper, latest, pending uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if k.busy {
+		return false
+	}
+
+	switch {
+	case latest > k.nonce:
+		p.log.Warnf("keeper %s: nonce moved on chain %d -> %d", k.Addr.Hex(), k.nonce, latest)
+		k.nonce = latest
+	case k.nonce > pending:
+		p.log.Warnf("keeper %s: nonce gap local=%d pending=%d", k.Addr.Hex(), k.nonce, pending)
+		k.nonce = pending
+	}
+
+	if pending <= latest {
+		k.pendingSince = time.Time{}
+		if k.stuck {
+			p.log.Printf("keeper %s: recovered", k.Addr.Hex())
+			k.stuck = false
+		}
+		return false
+	}
+
+	if k.pendingSince.IsZero() {
+		k.pendingSince = time.Now()
+		return false
+	}
+
+	if time.Now().Sub(k.pendingSince) < StuckAfter {
+		return false
+	}
+
+	if !k.stuck {
+		p.log.Warnf("keeper %s: stuck latest=%d pending=%d", k.Addr.Hex(), latest, pending)
+		k.stuck = true
+	}
+
+	return true
+}
+
+// unstick replaces the oldest pending tx of k with a zero value self
+// transfer. Its fees are ReplaceBump over those of the tx signed for the
+// nonce, and no less than the node suggests; a tx k did not sign here, e.g.
+// before a restart, is outbid at double the suggested gas price.
+func (p *Keepers) unstick(ctx context.Context, k *Keeper, nonce uint64) error {
+	chainID, err := p.c.ChainID(ctx)
+	if err != nil {
+		return err
+	}
+
+	gp, err := p.c.SuggestGasPrice(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := k.signTx(replacement(chainID, k.signedAt(nonce), nonce, k.Addr, gp), chainID)
+	if err != nil {
+		return err
+	}
+
+	p.log.Warnf("keeper %s: replacing nonce %d tx=%s", k.Addr.Hex(), nonce, tx.Hash().Hex())
+
+	return p.c.SendTransaction(ctx, tx)
+}
+
+// replacement is a zero value transfer to self with nonce that outbids
+// prev, if known, and pays at least gp.
+func replacement(chainID *big.Int, prev *types.Transaction, nonce uint64, self common.Address, gp *big.Int) *types.Transaction {
+	if prev == nil {
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			To:       &self,
+			Gas:      21000,
+			GasPrice: new(big.Int).Mul(gp, big.NewInt(2)),
+			Value:    new(big.Int),
+		})
+	}
+
+	if prev.Type() != types.DynamicFeeTxType {
+		return types.NewTx(&types.LegacyTx{
+			Nonce:    nonce,
+			To:       &self,
+			Gas:      21000,
+			GasPrice: maxBig(mulf(prev.GasPrice(), ReplaceBump), gp),
+			Value:    new(big.Int),
+		})
+	}
+
+	tip := mulf(prev.GasTipCap(), ReplaceBump)
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: maxBig(maxBig(mulf(prev.GasFeeCap(), ReplaceBump), gp), tip),
+		Gas:       21000,
+		To:        &self,
+		Value:     new(big.Int),
+	})
+}
+
+func maxBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return b
+	}
+	return a
+}
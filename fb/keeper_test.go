@@ -0,0 +1,79 @@
+package fb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/signer"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestReplacement(t *testing.T) {
+	self := common.HexToAddress("0x1")
+	chainID := big.NewInt(1)
+
+	for _, tc := range []struct {
+		name        string
+		prev        types.TxData
+		gp          int64
+		price, tip  int64
+		dynamic     bool
+		outbidsPrev bool
+	}{
+		{"unknown", nil, 10, 20, 20, false, false},
+		{"legacy", &types.LegacyTx{GasPrice: big.NewInt(100)}, 10, 112, 112, false, true},
+		{"legacy below market", &types.LegacyTx{GasPrice: big.NewInt(100)}, 150, 150, 150, false, true},
+		{"dynamic", &types.DynamicFeeTx{GasTipCap: big.NewInt(40), GasFeeCap: big.NewInt(200)}, 10, 225, 45, true, true},
+		{"dynamic below market", &types.DynamicFeeTx{GasTipCap: big.NewInt(40), GasFeeCap: big.NewInt(200)}, 300, 300, 45, true, true},
+	} {
+		var prev *types.Transaction
+		if tc.prev != nil {
+			prev = types.NewTx(tc.prev)
+		}
+
+		tx := replacement(chainID, prev, 7, self, big.NewInt(tc.gp))
+
+		if tx.Nonce() != 7 || *tx.To() != self || tx.Value().Sign() != 0 || tx.Gas() != 21000 {
+			t.Errorf("%s: not a self transfer with the nonce", tc.name)
+		}
+		if (tx.Type() == types.DynamicFeeTxType) != tc.dynamic {
+			t.Errorf("%s: type %d", tc.name, tx.Type())
+		}
+		if tx.GasFeeCap().Int64() != tc.price || tx.GasTipCap().Int64() != tc.tip {
+			t.Errorf("%s: fee cap %s tip %s, want %d %d", tc.name, tx.GasFeeCap(), tx.GasTipCap(), tc.price, tc.tip)
+		}
+		if tc.outbidsPrev {
+			// geth takes a replacement 10% above both caps
+			if tx.GasFeeCap().Cmp(mulf(prev.GasFeeCap(), 1.1)) < 0 || tx.GasTipCap().Cmp(mulf(prev.GasTipCap(), 1.1)) < 0 {
+				t.Errorf("%s: does not outbid %s/%s", tc.name, prev.GasFeeCap(), prev.GasTipCap())
+			}
+		}
+	}
+}
+
+func TestSignedAt(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	k := &Keeper{signer: signer.FromKey(key)}
+
+	sign := func(nonce uint64, price int64) {
+		if _, err := k.signTx(types.NewTx(&types.LegacyTx{Nonce: nonce, GasPrice: big.NewInt(price), Gas: 21000}), big.NewInt(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sign(3, 100)
+	sign(3, 50)
+	sign(4, 10)
+
+	if tx := k.signedAt(3); tx == nil || tx.GasPrice().Int64() != 100 {
+		t.Errorf("nonce 3: %v, want the 100 wei tx", tx)
+	}
+
+	k.forget(4)
+	if k.signedAt(3) != nil || k.signedAt(4) == nil {
+		t.Error("forget(4) kept nonce 3 or dropped 4")
+	}
+}
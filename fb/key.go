@@ -1,37 +1,13 @@
 package fb
 
 import (
-	"crypto/ecdsa"
-	"encoding/json"
-	"errors"
-	"github.com/ethereum/go-ethereum/accounts/keystore"
-	"github.com/ethereum/go-ethereum/common"
-	"io/ioutil"
-	"os"
+	"github.com/0xnibbler/mev-q4-2020/util"
 )
 
-var passphrase = os.Getenv("PASSPHRASE")
+// KeeperSigners are the signer specs of the keeper accounts, see package
+// signer.
+var KeeperSigners = []string{"privatekey.json"}
 
-func ReadKey() (common.Address, *ecdsa.PrivateKey, error) {
-	b, err := ioutil.ReadFile("privatekey.json")
-	if err != nil {
-		return common.Address{}, nil, err
-	}
-
-	var m map[string]interface{}
-	if err := json.Unmarshal(b, &m); err != nil {
-		return common.Address{}, nil, err
-	}
-
-	pub, ok := m["address"].(string)
-	if !ok {
-		return common.Address{}, nil, errors.New("no pub addr")
-	}
-
-	k, err := keystore.DecryptKey(b, passphrase)
-	if err != nil {
-		return common.Address{}, nil, err
-	}
-
-	return common.HexToAddress(pub), k.PrivateKey, nil
-}
+// AuthSigner signs relay requests. It is the searcher's reputation identity
+// with the relays, so its keystore is created on first start and kept.
+var AuthSigner = "keystore:" + util.Path("flashbots_auth.json")
@@ -1,363 +1,321 @@
 package fb
 
 import (
-	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/big"
-	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
 	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/signer"
 
-	"github.com/ethereum/go-ethereum/accounts/abi"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type MEV struct {
 	c *rpc.Client
 
-	nonce uint64
-	id    int
+	id     int64
+	Relays []Relay
 
-	keeperAddr common.Address
-	keeperKey  *ecdsa.PrivateKey
+	Keepers  *Keepers
+	TxConfig TxConfig
+	Bribe    *Bribe
 
-	authAddr common.Address
-	authKey  *ecdsa.PrivateKey
+	chainID *big.Int
+
+	auth signer.Signer
 
 	toAddr common.Address
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
 }
 
-func New(c *rpc.Client, toAddr common.Address) *MEV {
-	priv, pub := genKey()
+func New(c *rpc.Client, toAddr common.Address, mt *metrics.Metrics) *MEV {
+	log := mt.WithField("context", "MEV")
 
-	fmt.Println("FLASHBOTS AUTH KEY\n", pub.Hex(), "\n", priv.D.String())
+	auth, created, err := signer.OpenOrCreate(AuthSigner)
+	if err != nil {
+		panic(errors.Wrap(err, "auth signer"))
+	}
+	if created {
+		log.Warnf("created relay auth key %s", auth.Address().Hex())
+	} else {
+		log.Printf("relay auth key %s", auth.Address().Hex())
+	}
 
-	keeperAddr, keeperKey, err := ReadKey()
+	keepers, err := NewKeepers(ethclient.NewClient(c), mt.WithField("context", "Keepers"), KeeperSigners...)
 	if err != nil {
 		panic(err)
 	}
 
-	m := &MEV{
-		c:          c,
-		keeperAddr: keeperAddr,
-		keeperKey:  keeperKey,
-		authAddr:   pub,
-		authKey:    priv,
-		toAddr:     toAddr,
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	n, err := m.getNonce()
+	chainID, err := ethclient.NewClient(c).ChainID(ctx)
 	if err != nil {
 		panic(err)
 	}
-	m.nonce = n
+
+	m := newMEV(auth, mt)
+	m.c = c
+	m.Keepers = keepers
+	m.chainID = chainID
+	m.toAddr = toAddr
 
 	return m
 }
 
+// newMEV returns an MEV that can only talk to relays, signing with auth.
+// New adds the node, the keepers and the executor.
+func newMEV(auth signer.Signer, mt *metrics.Metrics) *MEV {
+	return &MEV{
+		TxConfig: DefaultTxConfig,
+		Bribe:    NewBribe(BribeCoinbase, 0.5, mt),
+		auth:     auth,
+		Relays:   DefaultRelays,
+		metrics:  mt,
+		log:      mt.WithField("context", "MEV"),
+	}
+}
+
+func (m *MEV) Start(ctx context.Context) error {
+	return m.Keepers.Start(ctx, 15*time.Second)
+}
+
 type Exec struct {
-	lock sync.Mutex
-	run  bool
-	a    *abi.ABI
+	M   *MEV
+	Enc *executor.Encoder
 
-	M *MEV
+	lock     sync.Mutex
+	inflight map[uint64]*bundle
 }
 
+// ReplaceThreshold is by how much, relative to the margin a bundle was built
+// for, a cycle's return has to improve before its in-flight bundle is
+// replaced.
+var ReplaceThreshold = 0.2
+
+// Running reports whether every keeper is busy with a submission.
 func (e *Exec) Running() bool {
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	return e.run
+	return e.M.Keepers.Idle() == 0
 }
 
-var contractAbi = []byte("")
-
-func (e *Exec) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+// Updated is called by the scheduler when the return of a cycle with a
+// bundle in flight changed.
+func (e *Exec) Updated(c *model.Cycle, r float64) {
 	e.lock.Lock()
-	defer e.lock.Unlock()
-	if e.run {
-		return nil, errors.New("running")
-	}
+	b := e.inflight[c.Hash()]
+	improved := b != nil && r-1 > (b.ret-1)*(1+ReplaceThreshold)
+	e.lock.Unlock()
 
-	e.run = true
-	defer func() { e.run = false }()
-
-	if e.a == nil {
-		if a, err := abi.JSON(bytes.NewReader(contractAbi)); err != nil {
-			return nil, err
-		} else {
-			e.a = &a
+	if improved {
+		select {
+		case b.update <- r:
+		default:
 		}
 	}
-
-	data, err := e.a.Pack("")
-	if err != nil {
-		return nil, errors.Wrap(err, "ch.a.Pack")
-	}
-
-	ok, err := e.M.sendBundle(ctx, data)
-	return &model.RunResult{
-		Success:     ok,
-		Error:       err,
-	}, err
-}
-
-type bundleRequest struct {
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
-	ID      int           `json:"id"`
-	JsonRPC string        `json:"jsonrpc"`
 }
 
-func (m *MEV) callBundle(ctx context.Context, data []byte) error {
-	start := time.Now()
-	txbb, err := m.txBytes(m.toAddr, data)
-	if err != nil {
-		return err
-	}
-
-	targetBlockNum, err := ethclient.NewClient(m.c).BlockByNumber(ctx, nil)
-	if err != nil {
-		return err
+func (e *Exec) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	if c.TestRes == nil || !c.TestRes.Success {
+		return nil, errors.New("cycle not simulated")
 	}
 
-	br := &bundleRequest{
-		Method: "eth_callBundle",
-		Params: []interface{}{
-			[]interface{}{hexutil.Bytes(txbb).String()},
-			fmt.Sprintf("0x%x", targetBlockNum.NumberU64()+1),
-			"latest"},
-		ID:      m.id,
-		JsonRPC: "2.0",
-	}
-	resp, err := m.send(br)
+	k, err := e.M.Keepers.Acquire()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	r := resp.(BundleCallRes)
-
-	gp, _ := strconv.Atoi(r.BundleGasPrice)
-	var gu int64
-	if gp > 0 && len(r.Results) == 1 {
-		gu = r.Results[0].GasUsed
+	cur, err := e.build(ctx, k, c, ethToWei(c.TestRes.Return), 0)
+	if cur == nil {
+		e.M.Keepers.Release(k, false)
+		return nil, err
 	}
-	fmt.Println("eth_callBundle  GP =", gp/1e+9, "gwei  GU =", gu)
-	fmt.Printf("%#v  start=%v\n", r, time.Now().Sub(start))
-	return nil
-}
 
-func (m *MEV) sendBundle(ctx context.Context, data []byte) (bool, error) {
-	txbb, err := m.txBytes(m.toAddr, data)
-	if err != nil {
-		return false, err
+	res := &model.RunResult{
+		GasUsed:     cur.gas,
+		MaxGasPrice: cur.tx.GasTipCap().Uint64(),
+		TargetBlock: cur.target,
+		Sim:         cur.sim,
+		Error:       err,
 	}
-
-	block, err := ethclient.NewClient(m.c).BlockByNumber(ctx, nil)
 	if err != nil {
-		return false, err
+		e.M.Keepers.Release(k, false)
+		return res, err
 	}
 
-	targetBlockNum := block.NumberU64() + 1
-
-	br := &bundleRequest{
-		Method: "eth_sendBundle",
-		Params: []interface{}{
-			[]interface{}{hexutil.Bytes(txbb).String()},
-			fmt.Sprintf("0x%x", targetBlockNum),
-			0, 0},
-		ID:      m.id,
-		JsonRPC: "2.0",
-	}
-
-	m.id++
-
-	if _, err := m.send(br); err != nil {
-		return false, err
-	}
+	b := newBundle(c.Return, func(r float64, target uint64) ([]*types.Transaction, error) {
+		e.lock.Lock()
+		r0 := e.inflight[c.Hash()].ret
+		e.lock.Unlock()
 
-	return m.waitForTx(targetBlockNum)
-}
+		if r0 <= 1 {
+			return nil, errors.New("no margin to scale")
+		}
 
-func (m *MEV) waitForTx(targetBlock uint64) (bool, error) {
-	ch := make(chan *types.Header)
-	subs, err := ethclient.NewClient(m.c).SubscribeNewHead(context.Background(), ch)
-	if err != nil {
-		return false, err
-	}
+		profit, _ := new(big.Float).Mul(new(big.Float).SetInt(cur.sim.Profit), big.NewFloat((r-1)/(r0-1))).Int(nil)
 
-	defer subs.Unsubscribe()
-	for {
-		select {
-		case err := <-subs.Err():
-			return false, err
-		case h := <-ch:
-			if h.Number.Uint64() < targetBlock {
-				continue
-			}
-
-			n, err := m.getNonce()
-			if err != nil {
-				return false, err
-			}
-
-			if n > m.nonce {
-				m.nonce = n
-				return true, nil
-			} else {
-				return false, nil
-			}
+		next, err := e.build(ctx, k, c, profit, target)
+		if err != nil {
+			return nil, err
 		}
-	}
-}
 
-func (m *MEV) getNonce() (uint64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancel()
+		e.lock.Lock()
+		e.inflight[c.Hash()].ret = r
+		e.lock.Unlock()
 
-	return ethclient.NewClient(m.c).NonceAt(ctx, m.keeperAddr, nil)
-}
-
-func (m *MEV) txBytes(to common.Address, data []byte) ([]byte, error) {
-	rawTx := types.NewTx(&types.LegacyTx{
-		Nonce:    m.nonce,
-		Gas:      1500000,
-		To:       &to,
-		Data:     data,
-		GasPrice: new(big.Int),
-		Value:    new(big.Int),
+		cur = next
+		return []*types.Transaction{next.tx}, nil
 	})
 
-	signedTx, err := signTx(m.keeperKey, m.keeperAddr, rawTx)
-	if err != nil {
-		return nil, err
+	e.lock.Lock()
+	if e.inflight == nil {
+		e.inflight = make(map[uint64]*bundle)
+	}
+	e.inflight[c.Hash()] = b
+	e.lock.Unlock()
+
+	defer func() {
+		e.lock.Lock()
+		delete(e.inflight, c.Hash())
+		e.lock.Unlock()
+	}()
+
+	res.Sent = true
+	incl, err := e.M.track(ctx, k, []*types.Transaction{cur.tx}, cur.target, b)
+	e.M.Keepers.Release(k, incl != nil)
+	if err == nil {
+		e.M.Bribe.Outcome(cur.d, incl != nil)
 	}
 
-	return rlp.EncodeToBytes(signedTx)
-}
-
-type BundleCallResElem struct {
-	GasUsed int64       `json:"gasUsed"`
-	TxHash  common.Hash `json:"txHash"`
-	Value   string      `json:"value"`
+	if incl != nil {
+		res.TargetBlock = incl.Block
+		res.Txs = []common.Hash{incl.Tx}
+	}
+	res.GasUsed = cur.gas
+	res.MaxGasPrice = cur.tx.GasTipCap().Uint64()
+	res.Sim = cur.sim
+	res.Success = incl != nil
+	res.Error = err
+	return res, err
 }
 
-type BundleCallRes struct {
-	Id                int                 `json:"id"`
-	BundleGasPrice    string              `json:"bundleGasPrice"`
-	BundleHash        common.Hash         `json:"bundleHash"`
-	CoinbaseDiff      string              `json:"coinbaseDiff"`
-	EthSentToCoinbase string              `json:"ethSentToCoinbase"`
-	GasFees           string              `json:"gasFees"`
-	Results           []BundleCallResElem `json:"results"`
+type built struct {
+	tx     *types.Transaction
+	d      *BribeDecision
+	sim    *model.BundleSim
+	gas    uint64
+	target uint64
 }
 
-func (m *MEV) send(br *bundleRequest) (interface{}, error) {
-	bb, err := json.Marshal(br)
+// build signs the executor call for c with k's current nonce and a bribe
+// out of profit, and gates it on eth_callBundle for target, or the next
+// block if it is 0. On a failed gate the result is returned together with
+// the error.
+func (e *Exec) build(ctx context.Context, k *Keeper, c *model.Cycle, profit *big.Int, target uint64) (*built, error) {
+	head, err := ethclient.NewClient(e.M.c).HeaderByNumber(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println(string(bb))
-
-	signature, err := ethSign(crypto.Keccak256Hash(bb).Hex(), m.authKey)
-	if err != nil {
-		return nil, err
+	b := &built{
+		target: target,
+		gas:    c.TestRes.GasUsed,
 	}
-
-	fmt.Println(hexutil.Encode(signature))
-
-	c := http.Client{Timeout: time.Second * 5}
-	req, _ := http.NewRequest(http.MethodPost, "https://relay.flashbots.net", bytes.NewBuffer(bb))
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Flashbots-Signature", m.authAddr.Hex()+":"+hexutil.Encode(signature))
-
-	resp, err := c.Do(req)
-	if err != nil {
-		return nil, err
+	if b.target == 0 {
+		b.target = head.Number.Uint64() + 1
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		errStr := ""
-		if bb, err := ioutil.ReadAll(resp.Body); err == nil {
-			errStr = ": " + string(bb)
-		}
+	b.d = e.M.Bribe.Decide(profit)
 
-		return nil, fmt.Errorf("bad status code %d%s", resp.StatusCode, errStr)
+	data, err := e.Enc.Pack(c, &executor.Params{Bribe: b.d.coinbase()})
+	if err != nil {
+		return nil, errors.Wrap(err, "e.Enc.Pack")
 	}
 
-	if br.Method == "eth_sendBundle" {
-		return nil, nil
-	}
+	al := e.M.keeperAccessList(ctx, k, e.Enc.From, data, b.gas, c.TestRes.AccessList)
 
-	r := struct {
-		ID      int           `json:"id"`
-		Jsonrpc string        `json:"jsonrpc"`
-		Result  BundleCallRes `json:"result"`
-	}{}
-	err = json.NewDecoder(resp.Body).Decode(&r)
+	b.tx, err = e.M.newTx(k, e.M.toAddr, data, b.gas, head.BaseFee, b.d.tip(e.M.TxConfig.gasLimit(b.gas)), al)
 	if err != nil {
 		return nil, err
 	}
 
-	return r.Result, nil
-}
-
-func genKey() (*ecdsa.PrivateKey, common.Address) {
-	keeperKey, err := crypto.GenerateKey()
+	cr, err := e.M.callBundle(ctx, []*types.Transaction{b.tx}, b.target, head.Number.Uint64())
 	if err != nil {
-		panic(err)
+		return b, errors.Wrap(err, "eth_callBundle")
 	}
 
-	publicKey := keeperKey.Public()
-
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		panic("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
+	b.sim = bundleSim(cr, head.Number.Uint64(), head.BaseFee, profit, e.Enc.Unpack)
+	if err := checkSim(b.sim, MinProfit); err != nil {
+		return b, err
 	}
+	b.gas = b.sim.GasUsed
 
-	address := crypto.PubkeyToAddress(*publicKeyECDSA)
+	return b, nil
+}
 
-	return keeperKey, address
+type bundleRequest struct {
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int           `json:"id"`
+	JsonRPC string        `json:"jsonrpc"`
 }
 
-func signTx(key *ecdsa.PrivateKey, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
-	signer := types.HomesteadSigner{}
+// sendBundle submits txs in order for targetBlockNum. Bundles sent with the
+// same non empty uuid replace each other on relays that support it.
+func (m *MEV) sendBundle(ctx context.Context, txs []*types.Transaction, targetBlockNum uint64, uuid string) error {
+	var raw []string
+	for _, tx := range txs {
+		txbb, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		raw = append(raw, hexutil.Bytes(txbb).String())
+	}
 
-	if address != crypto.PubkeyToAddress(key.PublicKey) {
-		return nil, bind.ErrNotAuthorized
+	p := map[string]interface{}{
+		"txs":         raw,
+		"blockNumber": fmt.Sprintf("0x%x", targetBlockNum),
+	}
+	if uuid != "" {
+		p["replacementUuid"] = uuid
 	}
 
-	signature, err := crypto.Sign(signer.Hash(tx).Bytes(), key)
-	if err != nil {
-		return nil, err
+	br := &bundleRequest{
+		Method:  "eth_sendBundle",
+		Params:  []interface{}{p},
+		ID:      m.nextID(),
+		JsonRPC: "2.0",
 	}
-	return tx.WithSignature(signer, signature)
-}
 
-const msgSigningPrefix = "\x19Ethereum Signed Message:\n"
+	_, err := m.sendAll(ctx, br)
+	return err
+}
 
-func ethSign(message string, keeperKey *ecdsa.PrivateKey) ([]byte, error) {
-	hash := crypto.Keccak256Hash([]byte(msgSigningPrefix + fmt.Sprintf("%d", len(message)) + message))
+// cancelBundle withdraws every bundle sent under uuid from the relays that
+// support eth_cancelBundle.
+func (m *MEV) cancelBundle(uuid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	signature, err := crypto.Sign(hash.Bytes(), keeperKey)
-	if err != nil {
-		return nil, err
+	br := &bundleRequest{
+		Method:  "eth_cancelBundle",
+		Params:  []interface{}{map[string]string{"replacementUuid": uuid}},
+		ID:      m.nextID(),
+		JsonRPC: "2.0",
 	}
 
-	return signature, nil
+	_, err := m.sendAll(ctx, br)
+	return err
 }
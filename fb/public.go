@@ -0,0 +1,453 @@
+package fb
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// PublicTipMultiplier scales the priority fee suggested by the node to
+	// outbid the average pending tx.
+	PublicTipMultiplier = 1.5
+
+	// PublicMaxGasShare caps the gas cost of a public tx as a share of the
+	// cycle's expected profit.
+	PublicMaxGasShare = 0.8
+
+	// PublicMaxBlocks is how many blocks a public tx may stay pending before
+	// it is cancelled.
+	PublicMaxBlocks = 3
+
+	// ReplaceBump is the fee increase of a same nonce replacement, geth
+	// requires at least 10%.
+	ReplaceBump = 1.125
+)
+
+var (
+	ErrFrontRun     = errors.New("public tx reverted, front-run")
+	ErrCancelled    = errors.New("public tx cancelled")
+	ErrNonceTaken   = errors.New("keeper nonce used by another tx")
+	ErrGasTooCostly = errors.New("competitive gas price exceeds profit")
+	ErrOverMaxFee   = errors.New("replacement fees exceed max fee")
+)
+
+const (
+	outcomeIncluded  = "included"
+	outcomeReverted  = "reverted"
+	outcomeCancelled = "cancelled"
+	outcomeReplaced  = "replaced"
+	outcomeTimeout   = "timeout"
+)
+
+// Public sends cycles as plain transactions to the public mempool. While a
+// tx is pending it is re-simulated on every block and cancelled once the
+// opportunity is gone, the cycle's Context is done or it has been pending
+// for PublicMaxBlocks; otherwise it is repriced if the market moved.
+type Public struct {
+	M   *MEV
+	Enc *executor.Encoder
+}
+
+func (p *Public) Running() bool {
+	return p.M.Keepers.Idle() == 0
+}
+
+func (p *Public) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	if c.TestRes == nil || !c.TestRes.Success {
+		return nil, errors.New("cycle not simulated")
+	}
+
+	k, err := p.M.Keepers.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	cl := ethclient.NewClient(p.M.c)
+
+	head, err := cl.HeaderByNumber(ctx, nil)
+	if err != nil {
+		p.M.Keepers.Release(k, false)
+		return nil, err
+	}
+
+	data, err := p.Enc.Pack(c, &executor.Params{})
+	if err != nil {
+		p.M.Keepers.Release(k, false)
+		return nil, errors.Wrap(err, "p.Enc.Pack")
+	}
+
+	gas := p.M.TxConfig.gasLimit(c.TestRes.GasUsed)
+	profit := ethToWei(c.TestRes.Return)
+
+	tip, err := p.tip(ctx, cl, gas, head.BaseFee, profit)
+	if err != nil {
+		p.M.Keepers.Release(k, false)
+		return nil, err
+	}
+
+	al := p.M.keeperAccessList(ctx, k, p.Enc.From, data, c.TestRes.GasUsed, c.TestRes.AccessList)
+
+	tx, err := p.M.newTx(k, p.M.toAddr, data, c.TestRes.GasUsed, head.BaseFee, tip, al)
+	if err != nil {
+		p.M.Keepers.Release(k, false)
+		return nil, err
+	}
+
+	if err := cl.SendTransaction(ctx, tx); err != nil {
+		p.M.Keepers.Release(k, false)
+		return nil, errors.Wrap(err, "eth_sendRawTransaction")
+	}
+
+	w := &pending{
+		p:      p,
+		cl:     cl,
+		k:      k,
+		data:   data,
+		gas:    gas,
+		profit: profit,
+		exec:   tx,
+		sent:   []*types.Transaction{tx},
+		log:    p.M.log.WithFields(logrus.Fields{"keeper": k.Addr.Hex(), "nonce": tx.Nonce()}),
+	}
+
+	res, consumed, err := w.watch(ctx, head.Number.Uint64())
+	p.M.Keepers.Release(k, consumed)
+
+	if res == nil {
+		res = &model.RunResult{Error: err}
+	}
+	res.Sent = true
+
+	return res, err
+}
+
+// tip is the competitive priority fee for gas units, limited so that gas
+// costs at most PublicMaxGasShare of profit.
+func (p *Public) tip(ctx context.Context, cl *ethclient.Client, gas uint64, baseFee, profit *big.Int) (*big.Int, error) {
+	suggested, err := cl.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tip := mulf(suggested, PublicTipMultiplier)
+	if tip.Cmp(p.M.TxConfig.PriorityFee) < 0 {
+		tip = new(big.Int).Set(p.M.TxConfig.PriorityFee)
+	}
+
+	max := new(big.Int).Div(mulf(profit, PublicMaxGasShare), new(big.Int).SetUint64(gas))
+	if baseFee != nil {
+		max.Sub(max, baseFee)
+	}
+
+	if max.Sign() <= 0 {
+		return nil, ErrGasTooCostly
+	}
+	if tip.Cmp(max) > 0 {
+		tip = max
+	}
+
+	return tip, nil
+}
+
+type pending struct {
+	p  *Public
+	cl *ethclient.Client
+	k  *Keeper
+
+	data   []byte
+	gas    uint64
+	profit *big.Int
+
+	exec   *types.Transaction
+	cancel *types.Transaction
+	sent   []*types.Transaction
+	reason string
+
+	log logrus.FieldLogger
+}
+
+// watch follows the txs sent with the keeper's nonce until one of them, or
+// a tx we did not send, is mined. consumed reports whether the nonce is
+// used up.
+func (w *pending) watch(ctx context.Context, first uint64) (res *model.RunResult, consumed bool, err error) {
+	ch := make(chan *types.Header)
+	subs, err := w.cl.SubscribeNewHead(context.Background(), ch)
+	if err != nil {
+		return nil, false, err
+	}
+	defer subs.Unsubscribe()
+
+	done := ctx.Done()
+
+	for {
+		select {
+		case err := <-subs.Err():
+			return nil, false, err
+		case <-done:
+			done = nil
+			w.doCancel(nil, "context done")
+		case h := <-ch:
+			if res, ok := w.mined(); ok {
+				return res, true, res.Error
+			}
+
+			n, err := w.nonceAt()
+			if err != nil {
+				w.log.WithError(err).Warnln("nonce")
+				continue
+			}
+			if n > w.k.nonce {
+				// the receipt may lag behind the nonce
+				if res, ok := w.mined(); ok {
+					return res, true, res.Error
+				}
+				w.p.M.metrics.MetricPublic(outcomeReplaced)
+				return &model.RunResult{Error: ErrNonceTaken}, true, ErrNonceTaken
+			}
+
+			if w.cancel != nil {
+				if h.Number.Uint64() >= first+uint64(2*PublicMaxBlocks) {
+					w.p.M.metrics.MetricPublic(outcomeTimeout)
+					return &model.RunResult{Error: ErrCancelled}, false, errors.Wrap(ErrCancelled, "cancel still pending")
+				}
+				continue
+			}
+
+			if h.Number.Uint64() >= first+uint64(PublicMaxBlocks) {
+				w.doCancel(h.BaseFee, "pending too long")
+				continue
+			}
+
+			if ok, why := w.profitable(h.BaseFee); !ok {
+				w.doCancel(h.BaseFee, why)
+				continue
+			}
+
+			w.reprice(h.BaseFee)
+		}
+	}
+}
+
+// mined looks for a receipt of any tx sent so far.
+func (w *pending) mined() (*model.RunResult, bool) {
+	for _, tx := range w.sent {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		r, err := w.cl.TransactionReceipt(ctx, tx.Hash())
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		res := &model.RunResult{
+			GasUsed:     r.GasUsed,
+			MaxGasPrice: tx.GasTipCap().Uint64(),
+			TargetBlock: r.BlockNumber.Uint64(),
+			Txs:         []common.Hash{tx.Hash()},
+		}
+
+		switch {
+		case tx == w.cancel:
+			w.p.M.metrics.MetricPublic(outcomeCancelled)
+			res.Error = errors.Wrap(ErrCancelled, w.reason)
+		case r.Status != types.ReceiptStatusSuccessful:
+			w.p.M.metrics.MetricPublic(outcomeReverted)
+			res.Error = ErrFrontRun
+		default:
+			w.p.M.metrics.MetricPublic(outcomeIncluded)
+			res.Success = true
+		}
+
+		w.log.WithField("tx", tx.Hash().Hex()).Printf("mined in %d success=%t", res.TargetBlock, res.Success)
+
+		return res, true
+	}
+
+	return nil, false
+}
+
+func (w *pending) nonceAt() (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	return w.cl.NonceAt(ctx, w.k.Addr, nil)
+}
+
+// profitable re-simulates the call against the latest state. A revert or a
+// profit below the gas cost means the opportunity is gone.
+func (w *pending) profitable(baseFee *big.Int) (bool, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	to := w.p.M.toAddr
+	out, err := w.cl.CallContract(ctx, ethereum.CallMsg{
+		From:       w.k.Addr,
+		To:         &to,
+		Gas:        w.gas,
+		Data:       w.data,
+		AccessList: w.exec.AccessList(),
+	}, nil)
+	if err != nil {
+		return false, "simulation reverted: " + err.Error()
+	}
+
+	profit, err := w.p.Enc.Unpack(out)
+	if err != nil {
+		return false, "simulation: " + err.Error()
+	}
+
+	cost := new(big.Int).Mul(new(big.Int).SetUint64(w.gas), w.exec.GasTipCap())
+	if baseFee != nil {
+		cost.Add(cost, new(big.Int).Mul(new(big.Int).SetUint64(w.gas), baseFee))
+	}
+
+	if profit.Cmp(cost) <= 0 {
+		return false, "profit " + profit.String() + " below gas cost " + cost.String()
+	}
+
+	w.profit = profit
+	return true, ""
+}
+
+// reprice replaces the pending tx when the competitive tip moved above it.
+func (w *pending) reprice(baseFee *big.Int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tip, err := w.p.tip(ctx, w.cl, w.gas, baseFee, w.profit)
+	if err != nil || tip.Cmp(mulf(w.exec.GasTipCap(), ReplaceBump)) < 0 {
+		return
+	}
+
+	to := w.p.M.toAddr
+	tx, err := w.p.M.replaceTx(w.k, w.exec, to, w.data, w.gas, baseFee, tip, w.exec.AccessList())
+	if err != nil {
+		w.log.WithError(err).Warnln("reprice")
+		return
+	}
+
+	if err := w.cl.SendTransaction(ctx, tx); err != nil {
+		w.log.WithError(err).Warnln("reprice")
+		return
+	}
+
+	w.log.Printf("repriced tip %s -> %s", w.exec.GasTipCap(), tx.GasTipCap())
+	w.exec = tx
+	w.sent = append(w.sent, tx)
+}
+
+// doCancel replaces the pending tx with a zero value self transfer.
+func (w *pending) doCancel(baseFee *big.Int, reason string) {
+	if w.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if baseFee == nil {
+		if h, err := w.cl.HeaderByNumber(ctx, nil); err == nil {
+			baseFee = h.BaseFee
+		}
+	}
+
+	tx, err := w.p.M.replaceTx(w.k, w.exec, w.k.Addr, nil, 21000, baseFee, w.exec.GasTipCap(), nil)
+	if err != nil {
+		w.log.WithError(err).Warnln("cancel")
+		return
+	}
+
+	if err := w.cl.SendTransaction(ctx, tx); err != nil {
+		w.log.WithError(err).Warnln("cancel")
+		return
+	}
+
+	w.log.WithField("tx", tx.Hash().Hex()).Warnln("cancelling:", reason)
+	w.cancel = tx
+	w.reason = reason
+	w.sent = append(w.sent, tx)
+}
+
+// replaceTx signs a tx with the nonce of prev whose fees are at least
+// ReplaceBump above those of prev and pay at least tip. It is built like
+// newTxAt: legacy if configured or prev was, with the tip and fee cap held
+// to MaxFee. A replacement the cap leaves below the bump would be refused by
+// the node and is not signed.
+func (m *MEV) replaceTx(k *Keeper, prev *types.Transaction, to common.Address, data []byte, gas uint64, baseFee, tip *big.Int, al types.AccessList) (*types.Transaction, error) {
+	tc := m.TxConfig
+	maxFee := tc.MaxFee
+	if maxFee != nil && maxFee.Sign() <= 0 {
+		maxFee = nil
+	}
+
+	var rawTx *types.Transaction
+
+	if tc.Legacy || prev.Type() != types.DynamicFeeTxType {
+		gp := mulf(prev.GasFeeCap(), ReplaceBump)
+		if min := new(big.Int).Add(tip, orZero(baseFee)); gp.Cmp(min) < 0 {
+			gp = min
+		}
+		if maxFee != nil && gp.Cmp(maxFee) > 0 {
+			gp = maxFee
+		}
+
+		rawTx = legacyTx(m.chainID, prev.Nonce(), gas, to, data, gp, al)
+	} else {
+		tipCap := mulf(prev.GasTipCap(), ReplaceBump)
+		if tipCap.Cmp(tip) < 0 {
+			tipCap = tip
+		}
+
+		feeCap := mulf(prev.GasFeeCap(), ReplaceBump)
+		if min := new(big.Int).Add(new(big.Int).Mul(orZero(baseFee), big.NewInt(2)), tipCap); feeCap.Cmp(min) < 0 {
+			feeCap = min
+		}
+
+		if maxFee != nil && feeCap.Cmp(maxFee) > 0 {
+			feeCap = maxFee
+		}
+		if tipCap.Cmp(feeCap) > 0 {
+			tipCap = feeCap
+		}
+
+		rawTx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:    m.chainID,
+			Nonce:      prev.Nonce(),
+			GasTipCap:  tipCap,
+			GasFeeCap:  feeCap,
+			Gas:        gas,
+			To:         &to,
+			Data:       data,
+			Value:      new(big.Int),
+			AccessList: al,
+		})
+	}
+
+	if rawTx.GasFeeCap().Cmp(mulf(prev.GasFeeCap(), ReplaceBump)) < 0 || rawTx.GasTipCap().Cmp(mulf(prev.GasTipCap(), ReplaceBump)) < 0 {
+		return nil, errors.Wrap(ErrOverMaxFee, maxFee.String())
+	}
+
+	return k.signTx(rawTx, m.chainID)
+}
+
+func mulf(b *big.Int, f float64) *big.Int {
+	r, _ := new(big.Float).Mul(new(big.Float).SetInt(b), big.NewFloat(f)).Int(nil)
+	return r
+}
+
+func orZero(b *big.Int) *big.Int {
+	if b == nil {
+		return new(big.Int)
+	}
+	return b
+}
@@ -0,0 +1,70 @@
+package fb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/signer"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+func TestReplaceTx(t *testing.T) {
+	m, key := testMEV(t)
+	m.chainID = big.NewInt(1)
+	k := &Keeper{signer: signer.FromKey(key)}
+	to := common.HexToAddress("0x1")
+
+	dynamic := types.NewTx(&types.DynamicFeeTx{ChainID: m.chainID, Nonce: 4, GasTipCap: big.NewInt(40), GasFeeCap: big.NewInt(200)})
+	legacy := types.NewTx(&types.LegacyTx{Nonce: 4, GasPrice: big.NewInt(100)})
+
+	for _, tc := range []struct {
+		name    string
+		prev    *types.Transaction
+		legacy  bool
+		maxFee  int64
+		tip     int64
+		baseFee int64
+
+		typ         uint8
+		feeCap, gtc int64
+		err         error
+	}{
+		{"bump", dynamic, false, 0, 10, 50, types.DynamicFeeTxType, 225, 45, nil},
+		{"market", dynamic, false, 0, 60, 100, types.DynamicFeeTxType, 260, 60, nil},
+		{"capped", dynamic, false, 240, 60, 100, types.DynamicFeeTxType, 240, 60, nil},
+		{"cap below bump", dynamic, false, 220, 10, 50, 0, 0, 0, ErrOverMaxFee},
+		{"legacy configured", dynamic, true, 0, 10, 50, types.LegacyTxType, 225, 225, nil},
+		{"legacy", legacy, false, 0, 10, 50, types.LegacyTxType, 112, 112, nil},
+		{"legacy capped", legacy, false, 115, 100, 50, types.LegacyTxType, 115, 115, nil},
+		{"legacy cap below bump", legacy, false, 110, 10, 50, 0, 0, 0, ErrOverMaxFee},
+	} {
+		m.TxConfig = DefaultTxConfig
+		m.TxConfig.Legacy = tc.legacy
+		m.TxConfig.MaxFee = big.NewInt(tc.maxFee)
+
+		tx, err := m.replaceTx(k, tc.prev, to, nil, 21000, big.NewInt(tc.baseFee), big.NewInt(tc.tip), nil)
+		if tc.err != nil {
+			if errors.Cause(err) != tc.err {
+				t.Errorf("%s: err %v, want %v", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if tx.Type() != tc.typ || tx.Nonce() != 4 {
+			t.Errorf("%s: type %d nonce %d", tc.name, tx.Type(), tx.Nonce())
+		}
+		if tx.GasFeeCap().Int64() != tc.feeCap || tx.GasTipCap().Int64() != tc.gtc {
+			t.Errorf("%s: fee cap %s tip %s, want %d %d", tc.name, tx.GasFeeCap(), tx.GasTipCap(), tc.feeCap, tc.gtc)
+		}
+		if from, _ := types.Sender(types.LatestSignerForChainID(m.chainID), tx); from != crypto.PubkeyToAddress(key.PublicKey) {
+			t.Errorf("%s: signed by %s", tc.name, from.Hex())
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package fb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	SigningFlashbots = "flashbots"
+	SigningNone      = "none"
+)
+
+type Relay struct {
+	Name    string        `json:"name"`
+	URL     string        `json:"url"`
+	Signing string        `json:"signing"`
+	Methods []string      `json:"methods"`
+	Timeout time.Duration `json:"-"`
+
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+var DefaultRelays = []Relay{{
+	Name:    "flashbots",
+	URL:     "https://relay.flashbots.net",
+	Signing: SigningFlashbots,
+	Timeout: 5 * time.Second,
+}}
+
+// LoadRelays reads a JSON list of relays. An empty methods list means the
+// relay accepts every bundle method.
+func LoadRelays(file string) ([]Relay, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rr []Relay
+	if err := json.Unmarshal(b, &rr); err != nil {
+		return nil, err
+	}
+
+	for i := range rr {
+		switch rr[i].Signing {
+		case "":
+			rr[i].Signing = SigningFlashbots
+		case SigningFlashbots, SigningNone:
+		default:
+			return nil, fmt.Errorf("relay %s: unknown signing %q", rr[i].Name, rr[i].Signing)
+		}
+
+		rr[i].Timeout = time.Duration(rr[i].TimeoutMs) * time.Millisecond
+		if rr[i].Timeout == 0 {
+			rr[i].Timeout = 5 * time.Second
+		}
+	}
+
+	return rr, nil
+}
+
+func (r *Relay) Supports(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+type RelayResult struct {
+	Relay    string
+	Accepted bool
+	Result   json.RawMessage
+	Err      error
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (m *MEV) nextID() int {
+	return int(atomic.AddInt64(&m.id, 1))
+}
+
+// sendAll posts br to every relay supporting its method in parallel. It
+// fails only if no relay accepted the request.
+func (m *MEV) sendAll(ctx context.Context, br *bundleRequest) ([]RelayResult, error) {
+	bb, err := json.Marshal(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var rr []RelayResult
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := range m.Relays {
+		r := &m.Relays[i]
+		if !r.Supports(br.Method) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := m.post(ctx, r, bb)
+			rres := RelayResult{Relay: r.Name, Accepted: err == nil, Result: res, Err: err}
+
+			m.metrics.MetricRelay(r.Name, br.Method, rres.Accepted)
+			if err != nil {
+				m.log.WithError(err).WithField("relay", r.Name).Warnln(br.Method, "rejected")
+			}
+
+			lock.Lock()
+			rr = append(rr, rres)
+			lock.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if len(rr) == 0 {
+		return nil, errors.New("no relay supports " + br.Method)
+	}
+
+	var errs []string
+	for _, r := range rr {
+		if r.Accepted {
+			return rr, nil
+		}
+		errs = append(errs, r.Relay+": "+r.Err.Error())
+	}
+
+	return rr, errors.New(br.Method + ": " + strings.Join(errs, "; "))
+}
+
+// call posts br to the first relay supporting its method.
+func (m *MEV) call(ctx context.Context, br *bundleRequest) (json.RawMessage, error) {
+	bb, err := json.Marshal(br)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range m.Relays {
+		r := &m.Relays[i]
+		if r.Supports(br.Method) {
+			res, err := m.post(ctx, r, bb)
+			m.metrics.MetricRelay(r.Name, br.Method, err == nil)
+			return res, err
+		}
+	}
+
+	return nil, errors.New("no relay supports " + br.Method)
+}
+
+func (m *MEV) post(ctx context.Context, r *Relay, body []byte) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	if r.Signing == SigningFlashbots {
+		signature, err := m.auth.SignText([]byte(crypto.Keccak256Hash(body).Hex()))
+		if err != nil {
+			return nil, errors.Wrap(err, "auth sign")
+		}
+		req.Header.Add("X-Flashbots-Signature", m.auth.Address().Hex()+":"+hexutil.Encode(signature))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errStr := ""
+		if bb, err := ioutil.ReadAll(resp.Body); err == nil {
+			errStr = ": " + string(bb)
+		}
+
+		return nil, fmt.Errorf("bad status code %d%s", resp.StatusCode, errStr)
+	}
+
+	var rr rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return nil, err
+	}
+
+	if rr.Error != nil {
+		return nil, fmt.Errorf("rpc error %d: %s", rr.Error.Code, rr.Error.Message)
+	}
+
+	return rr.Result, nil
+}
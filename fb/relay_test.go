@@ -0,0 +1,268 @@
+package fb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/fb/relaytest"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/signer"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+func testMEV(t *testing.T, relays ...*relaytest.Server) (*MEV, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	metrics.On = false
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	m := newMEV(signer.FromKey(key), &metrics.Metrics{FieldLogger: log})
+	m.Relays = nil
+	for i, s := range relays {
+		m.Relays = append(m.Relays, Relay{
+			Name:    string(rune('a' + i)),
+			URL:     s.URL,
+			Signing: SigningFlashbots,
+			Timeout: 5 * time.Second,
+		})
+	}
+
+	return m, key
+}
+
+func testTx(t *testing.T, key *ecdsa.PrivateKey, nonce uint64) *types.Transaction {
+	t.Helper()
+
+	to := common.HexToAddress("0x1")
+	tx, err := signer.FromKey(key).SignTx(types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		Nonce:     nonce,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(2),
+		Gas:       21000,
+		To:        &to,
+		Value:     new(big.Int),
+	}), big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestSendAll(t *testing.T) {
+	a, b, c := relaytest.NewServer(), relaytest.NewServer(), relaytest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	b.Reject = func(r *relaytest.Request) error { return errors.New("bundle too late") }
+
+	m, key := testMEV(t, a, b, c)
+	// c only takes signed requests
+	m.Relays[2].Signing = SigningNone
+
+	if err := m.sendBundle(context.Background(), []*types.Transaction{testTx(t, key, 0)}, 100, ""); err != nil {
+		t.Fatal("one relay accepted, sendBundle failed:", err)
+	}
+
+	rr, err := m.sendAll(context.Background(), &bundleRequest{Method: "eth_sendBundle", Params: []interface{}{map[string]interface{}{}}, ID: m.nextID(), JsonRPC: "2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 3 {
+		t.Fatalf("%d results, want 3", len(rr))
+	}
+
+	byRelay := make(map[string]RelayResult)
+	for _, r := range rr {
+		byRelay[r.Relay] = r
+	}
+	if r := byRelay["a"]; !r.Accepted || r.Err != nil {
+		t.Errorf("relay a: accepted %t err %v", r.Accepted, r.Err)
+	}
+	if r := byRelay["b"]; r.Accepted || r.Err == nil || !strings.Contains(r.Err.Error(), "bundle too late") {
+		t.Errorf("relay b: accepted %t err %v", r.Accepted, r.Err)
+	}
+	if r := byRelay["c"]; r.Accepted || r.Err == nil || !strings.Contains(r.Err.Error(), "403") {
+		t.Errorf("relay c: accepted %t err %v", r.Accepted, r.Err)
+	}
+
+	for _, s := range []*relaytest.Server{a, b} {
+		for _, r := range s.Requests() {
+			if r.Signer != m.auth.Address() {
+				t.Errorf("request signed by %s, want %s", r.Signer.Hex(), m.auth.Address().Hex())
+			}
+		}
+	}
+	if n := len(c.Requests()); n != 0 {
+		t.Errorf("relay c recorded %d unsigned requests", n)
+	}
+
+	a.Reject = b.Reject
+	if _, err := m.sendAll(context.Background(), &bundleRequest{Method: "eth_sendBundle", ID: m.nextID(), JsonRPC: "2.0"}); err == nil {
+		t.Error("no relay accepted, sendAll did not fail")
+	}
+}
+
+func TestSendAllMethods(t *testing.T) {
+	a, b := relaytest.NewServer(), relaytest.NewServer()
+	defer a.Close()
+	defer b.Close()
+
+	m, _ := testMEV(t, a, b)
+	m.Relays[1].Methods = []string{"eth_sendBundle"}
+
+	if err := m.cancelBundle("uuid"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Requests()) != 1 || len(b.Requests()) != 0 {
+		t.Errorf("eth_cancelBundle went to %d and %d relays, want 1 and 0", len(a.Requests()), len(b.Requests()))
+	}
+}
+
+func TestSignature(t *testing.T) {
+	s := relaytest.NewServer()
+	defer s.Close()
+
+	m, _ := testMEV(t, s)
+
+	body := []byte(`{"method":"eth_sendBundle","params":[],"id":1,"jsonrpc":"2.0"}`)
+	sig, err := m.auth.SignText([]byte(crypto.Keccak256Hash(body).Hex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := m.auth.Address().Hex() + ":" + hexutil.Encode(sig)
+
+	if a, err := relaytest.VerifySignature(header, body); err != nil || a != m.auth.Address() {
+		t.Fatalf("signer %s err %v, want %s", a.Hex(), err, m.auth.Address().Hex())
+	}
+
+	if _, err := relaytest.VerifySignature(header, append(body, ' ')); err == nil {
+		t.Error("signature over another body accepted")
+	}
+
+	other, _ := crypto.GenerateKey()
+	forged := crypto.PubkeyToAddress(other.PublicKey).Hex() + ":" + hexutil.Encode(sig)
+	if _, err := relaytest.VerifySignature(forged, body); err == nil {
+		t.Error("signature claimed for another address accepted")
+	}
+
+	if _, err := relaytest.VerifySignature(m.auth.Address().Hex()+":0x1234", body); err == nil {
+		t.Error("short signature accepted")
+	}
+
+	// the relay itself refuses what does not verify
+	m.Relays[0].Signing = SigningNone
+	if _, err := m.call(context.Background(), &bundleRequest{Method: "eth_sendBundle", ID: 1, JsonRPC: "2.0"}); err == nil {
+		t.Error("unsigned request accepted")
+	}
+}
+
+func TestCallBundle(t *testing.T) {
+	s := relaytest.NewServer()
+	defer s.Close()
+
+	m, key := testMEV(t, s)
+	txs := []*types.Transaction{testTx(t, key, 0), testTx(t, key, 1)}
+
+	profit := big.NewInt(5e15)
+	s.CallBundle = func(r *relaytest.Request) interface{} {
+		return map[string]interface{}{
+			"bundleHash":       "0xabc",
+			"coinbaseDiff":     "1000000000000000",
+			"gasFees":          "300000",
+			"stateBlockNumber": 99,
+			"totalGasUsed":     150000,
+			"results": []map[string]interface{}{
+				{"txHash": txs[0].Hash().Hex(), "gasUsed": 50000},
+				{"txHash": txs[1].Hash().Hex(), "gasUsed": 100000, "value": hexutil.Encode(common.LeftPadBytes(profit.Bytes(), 32))},
+			},
+		}
+	}
+
+	res, err := m.callBundle(context.Background(), txs, 100, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.Requests()[0]
+	if req.Method != "eth_callBundle" || len(req.Params) != 3 {
+		t.Fatalf("request %s with %d params", req.Method, len(req.Params))
+	}
+	var raw []string
+	if err := json.Unmarshal(req.Params[0], &raw); err != nil || len(raw) != 2 {
+		t.Fatalf("txs %v err %v", raw, err)
+	}
+	var target, state string
+	_ = json.Unmarshal(req.Params[1], &target)
+	_ = json.Unmarshal(req.Params[2], &state)
+	if target != "0x64" || state != "0x63" {
+		t.Errorf("target %s state %s, want 0x64 0x63", target, state)
+	}
+
+	if res.StateBlockNumber != 99 || res.TotalGasUsed != 150000 || len(res.Results) != 2 {
+		t.Fatalf("parsed %+v", res)
+	}
+
+	unpack := func(out []byte) (*big.Int, error) { return new(big.Int).SetBytes(out), nil }
+	baseFee := big.NewInt(10)
+	sim := bundleSim(res, 99, baseFee, new(big.Int), unpack)
+
+	if sim.Reverted || sim.GasUsed != 150000 || sim.Profit.Cmp(profit) != 0 {
+		t.Fatalf("sim %+v", sim)
+	}
+	// profit less coinbase payments less base fee burnt
+	want := new(big.Int).Sub(profit, big.NewInt(1e15))
+	want.Sub(want, big.NewInt(10*150000))
+	if sim.NetProfit.Cmp(want) != 0 {
+		t.Errorf("net profit %s, want %s", sim.NetProfit, want)
+	}
+	if err := checkSim(sim, new(big.Int).Add(want, big.NewInt(1))); !errors.Is(err, ErrSimNoProfit) {
+		t.Errorf("checkSim above net profit: %v", err)
+	}
+
+	s.CallBundle = func(r *relaytest.Request) interface{} {
+		return map[string]interface{}{
+			"results": []map[string]interface{}{
+				{"txHash": txs[0].Hash().Hex(), "gasUsed": 50000},
+				{"txHash": txs[1].Hash().Hex(), "gasUsed": 30000, "error": "execution reverted", "revert": "INSUFFICIENT_OUTPUT_AMOUNT"},
+			},
+		}
+	}
+	res, err = m.callBundle(context.Background(), txs, 100, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim = bundleSim(res, 99, baseFee, profit, unpack)
+	if !sim.Reverted || sim.GasUsed != 80000 || sim.Profit.Cmp(profit) != 0 {
+		t.Errorf("reverted sim %+v", sim)
+	}
+	if err := checkSim(sim, nil); !errors.Is(err, ErrSimReverted) || !strings.Contains(err.Error(), "INSUFFICIENT_OUTPUT_AMOUNT") {
+		t.Errorf("checkSim reverted: %v", err)
+	}
+
+	s.CallBundle = func(r *relaytest.Request) interface{} {
+		return map[string]interface{}{"results": []map[string]interface{}{{"gasUsed": 1}}}
+	}
+	if _, err := m.callBundle(context.Background(), txs, 100, 99); err == nil {
+		t.Error("one result for two txs accepted")
+	}
+}
@@ -0,0 +1,148 @@
+// Package relaytest runs an in-process stand-in for a Flashbots relay so the
+// bundle submission path can be exercised offline. It does not import fb, so
+// fb's own tests can use it.
+package relaytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type Request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     int               `json:"id"`
+
+	Signer common.Address `json:"-"`
+}
+
+type Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*Request
+
+	// RequireSignature rejects requests without a valid X-Flashbots-Signature.
+	RequireSignature bool
+
+	// Reject, if set, makes the relay answer a JSON-RPC error for a method.
+	Reject func(r *Request) error
+
+	// CallBundle answers eth_callBundle. The default returns only the bundle
+	// hash.
+	CallBundle func(r *Request) interface{}
+}
+
+func NewServer() *Server {
+	s := &Server{RequireSignature: true}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) Requests() []*Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Request{}, s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	signer, err := VerifySignature(r.Header.Get("X-Flashbots-Signature"), body)
+	if err != nil && s.RequireSignature {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	req.Signer = signer
+
+	s.lock.Lock()
+	s.requests = append(s.requests, &req)
+	s.lock.Unlock()
+
+	if s.Reject != nil {
+		if err := s.Reject(&req); err != nil {
+			writeJSON(w, map[string]interface{}{
+				"id": req.ID, "jsonrpc": "2.0",
+				"error": map[string]interface{}{"code": -32000, "message": err.Error()},
+			})
+			return
+		}
+	}
+
+	var result interface{}
+	switch req.Method {
+	case "eth_sendBundle":
+		result = map[string]interface{}{"bundleHash": crypto.Keccak256Hash(body)}
+	case "eth_callBundle":
+		result = map[string]interface{}{"bundleHash": crypto.Keccak256Hash(body)}
+		if s.CallBundle != nil {
+			result = s.CallBundle(&req)
+		}
+	case "eth_cancelBundle":
+		result = nil
+	default:
+		writeJSON(w, map[string]interface{}{
+			"id": req.ID, "jsonrpc": "2.0",
+			"error": map[string]interface{}{"code": -32601, "message": "method not found"},
+		})
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"id": req.ID, "jsonrpc": "2.0", "result": result})
+}
+
+// VerifySignature checks an X-Flashbots-Signature header ("address:signature")
+// against body and returns the signing address.
+func VerifySignature(header string, body []byte) (common.Address, error) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || !common.IsHexAddress(parts[0]) {
+		return common.Address{}, fmt.Errorf("bad signature header %q", header)
+	}
+
+	sig, err := hexutil.Decode(parts[1])
+	if err != nil || len(sig) != 65 {
+		return common.Address{}, fmt.Errorf("bad signature %q", parts[1])
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+
+	msg := crypto.Keccak256Hash(body).Hex()
+	hash := crypto.Keccak256Hash([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg), msg)))
+
+	pub, err := crypto.SigToPub(hash.Bytes(), sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	addr := crypto.PubkeyToAddress(*pub)
+	if addr != common.HexToAddress(parts[0]) {
+		return addr, fmt.Errorf("signature from %s, header claims %s", addr.Hex(), parts[0])
+	}
+
+	return addr, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
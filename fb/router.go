@@ -0,0 +1,377 @@
+package fb
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/0xnibbler/mev-q4-2020/contracts/erc20"
+	"github.com/0xnibbler/mev-q4-2020/contracts/sushiswap"
+	"github.com/0xnibbler/mev-q4-2020/contracts/uniswapv2"
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+)
+
+// RouterDeadline is how many seconds past the latest block a swap is valid
+// for.
+var RouterDeadline = int64(120)
+
+var ErrRouterNoProfit = errors.New("router: no profit after slippage")
+
+const approveGas = 60000
+
+type amountsOuter interface {
+	GetAmountsOut(opts *bind.CallOpts, amountIn *big.Int, path []common.Address) ([]*big.Int, error)
+}
+
+type routerSwap struct {
+	amm    model.AMM
+	router common.Address
+	path   []common.Address
+	hop    int // the last hop of the cycle the swap makes
+
+	amountIn     *big.Int
+	amountOut    *big.Int
+	amountOutMin *big.Int
+}
+
+// Router executes cycles without an executor contract. Each run of hops on
+// the same AMM becomes one swapExactTokensForTokens on that AMM's Router02,
+// spending the keeper's own tokens, and the swaps are sent as one bundle,
+// preceded by any approvals they need. The keeper has to hold the cycle's
+// amount of WETH. The bribe is always paid as priority fee.
+type Router struct {
+	M *MEV
+
+	c       *ethclient.Client
+	routers map[model.AMM]common.Address
+	callers map[model.AMM]amountsOuter
+	sim     executor.Simulator
+
+	routerABI abi.ABI
+	erc20ABI  abi.ABI
+}
+
+// NewRouter returns a Router. m may be nil when it is only used as the
+// scheduler's checker.
+func NewRouter(c *rpc.Client, m *MEV) (*Router, error) {
+	r := &Router{
+		M: m,
+		c: ethclient.NewClient(c),
+		routers: map[model.AMM]common.Address{
+			model.AMMUniswapV2: model.UniswapV2RouterAddress,
+			model.AMMSushiswap: model.SushiswapRouterAddress,
+		},
+		callers: make(map[model.AMM]amountsOuter),
+	}
+
+	u2, err := uniswapv2.NewUniswapV2Router02Caller(model.UniswapV2RouterAddress, r.c)
+	if err != nil {
+		return nil, err
+	}
+	r.callers[model.AMMUniswapV2] = u2
+
+	su, err := sushiswap.NewUniswapV2Router02Caller(model.SushiswapRouterAddress, r.c)
+	if err != nil {
+		return nil, err
+	}
+	r.callers[model.AMMSushiswap] = su
+
+	if r.routerABI, err = abi.JSON(strings.NewReader(uniswapv2.UniswapV2Router02ABI)); err != nil {
+		return nil, err
+	}
+	if r.erc20ABI, err = abi.JSON(strings.NewReader(erc20.TokenABI)); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SetSimulator takes the minimum outputs of swaps against the latest state
+// from sim's exact hop outputs instead of the routers' quotes.
+func (r *Router) SetSimulator(sim executor.Simulator) {
+	r.sim = sim
+}
+
+func (r *Router) Running() bool {
+	return r.M.Keepers.Idle() == 0
+}
+
+// Check quotes c through the routers. It implements scheduler.Checker.
+func (r *Router) Check(ctx context.Context, c *model.Cycle, block *big.Int) (*model.RunResult, error) {
+	ss, err := r.quote(ctx, c, block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := ss[len(ss)-1].amountOut
+	profit := new(big.Int).Sub(out, c.Amt.Int())
+
+	return &model.RunResult{Success: true, Return: weiToEth(profit)}, nil
+}
+
+// swaps splits c into runs of hops on the same AMM.
+func (r *Router) swaps(c *model.Cycle) ([]*routerSwap, error) {
+	n := len(c.ParamAddrs)
+	if n == 0 || c.ParamAddrs[0] != model.WETHAddress {
+		return nil, errors.New("router: cycle does not start at WETH")
+	}
+
+	var ss []*routerSwap
+	for i := 0; i < n; i++ {
+		from, to, a := c.ParamAddrs[i], c.ParamAddrs[(i+1)%n], c.ParamAMMs[(i+1)%n]
+
+		if len(ss) > 0 && ss[len(ss)-1].amm == a {
+			ss[len(ss)-1].path = append(ss[len(ss)-1].path, to)
+			ss[len(ss)-1].hop = i
+			continue
+		}
+
+		router, ok := r.routers[a]
+		if !ok {
+			return nil, fmt.Errorf("router: no router for %s", a)
+		}
+
+		ss = append(ss, &routerSwap{amm: a, router: router, path: []common.Address{from, to}, hop: i})
+	}
+
+	return ss, nil
+}
+
+// quote simulates the swaps of c in order. Each swap spends the minimum
+// the previous one is allowed to return, its output less
+// executor.Slippage. Against the latest state that output is the exact
+// simulation of its last hop, if there is a simulator, scaled to the input
+// actually spent; a pair pays at least that for less.
+func (r *Router) quote(ctx context.Context, c *model.Cycle, block *big.Int) ([]*routerSwap, error) {
+	ss, err := r.swaps(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var outs []*big.Int
+	if block == nil && r.sim != nil {
+		if outs, err = r.sim.HopOuts(c); err != nil {
+			return nil, errors.Wrap(err, "router: simulate")
+		}
+	}
+
+	in, simIn := c.Amt.Int(), c.Amt.Int()
+	for _, s := range ss {
+		amts, err := r.callers[s.amm].GetAmountsOut(&bind.CallOpts{Context: ctx, BlockNumber: block}, in, s.path)
+		if err != nil {
+			return nil, errors.Wrap(err, "router: getAmountsOut")
+		}
+
+		s.amountIn = in
+		s.amountOut = amts[len(amts)-1]
+		if outs != nil {
+			out := outs[s.hop]
+			s.amountOutMin = mulf(new(big.Int).Div(new(big.Int).Mul(out, in), simIn), 1-executor.Slippage)
+			simIn = out
+		} else {
+			s.amountOutMin = mulf(s.amountOut, 1-executor.Slippage)
+		}
+		in = s.amountOutMin
+	}
+
+	return ss, nil
+}
+
+func (r *Router) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	k, err := r.M.Keepers.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	res, used, err := r.run(ctx, k, c)
+	r.M.Keepers.ReleaseN(k, used)
+
+	return res, err
+}
+
+func (r *Router) run(ctx context.Context, k *Keeper, c *model.Cycle) (*model.RunResult, uint64, error) {
+	head, err := r.c.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ss, err := r.quote(ctx, c, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	amt := c.Amt.Int()
+	if ss[len(ss)-1].amountOutMin.Cmp(amt) <= 0 {
+		return nil, 0, ErrRouterNoProfit
+	}
+
+	weth, err := erc20.NewTokenCaller(model.WETHAddress, r.c)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bal, err := weth.BalanceOf(&bind.CallOpts{Context: ctx}, k.Addr); err != nil {
+		return nil, 0, err
+	} else if bal.Cmp(amt) < 0 {
+		return nil, 0, fmt.Errorf("router: keeper %s holds %s WETH, needs %s", k.Addr.Hex(), bal, amt)
+	}
+
+	calls, err := r.calls(ctx, k, ss, head.Time)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	profit := new(big.Int).Sub(ss[len(ss)-1].amountOutMin, amt)
+	unpack := func(out []byte) (*big.Int, error) {
+		v, err := r.routerABI.Unpack("swapExactTokensForTokens", out)
+		if err != nil {
+			return nil, err
+		}
+		amts, ok := v[0].([]*big.Int)
+		if !ok || len(amts) == 0 {
+			return nil, errors.New("router: bad swap output")
+		}
+		return new(big.Int).Sub(amts[len(amts)-1], amt), nil
+	}
+
+	// first pass to learn the gas of every tx, the second is the gate
+	target := head.Number.Uint64() + 1
+	gas := make([]uint64, len(calls))
+	for i, cl := range calls {
+		gas[i] = cl.gas
+	}
+
+	txs, err := r.sign(k, calls, gas, head.BaseFee, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cr, err := r.M.callBundle(ctx, txs, target, head.Number.Uint64())
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "eth_callBundle")
+	}
+
+	var total uint64
+	for i, t := range cr.Results {
+		if t.GasUsed > 0 {
+			gas[i] = t.GasUsed
+		}
+		total += r.M.TxConfig.gasLimit(gas[i])
+	}
+
+	d := r.M.Bribe.Decide(profit)
+	tip := new(big.Int).Div(d.Amount, new(big.Int).SetUint64(total))
+
+	if txs, err = r.sign(k, calls, gas, head.BaseFee, tip); err != nil {
+		return nil, 0, err
+	}
+
+	res := &model.RunResult{
+		MaxGasPrice: tip.Uint64(),
+		TargetBlock: target,
+	}
+
+	if cr, err = r.M.callBundle(ctx, txs, target, head.Number.Uint64()); err != nil {
+		res.Error = errors.Wrap(err, "eth_callBundle")
+		return res, 0, res.Error
+	}
+
+	res.Sim = bundleSim(cr, head.Number.Uint64(), head.BaseFee, profit, unpack)
+	res.GasUsed = res.Sim.GasUsed
+	if err := checkSim(res.Sim, MinProfit); err != nil {
+		res.Error = err
+		return res, 0, err
+	}
+
+	res.Sent = true
+	incl, err := r.M.track(ctx, k, txs, target, newBundle(c.Return, nil))
+	if err == nil {
+		r.M.Bribe.Outcome(d, incl != nil)
+	}
+
+	res.Success = incl != nil
+	res.Error = err
+	if incl == nil {
+		return res, 0, err
+	}
+
+	res.TargetBlock = incl.Block
+	for _, tx := range txs {
+		res.Txs = append(res.Txs, tx.Hash())
+	}
+	return res, uint64(len(txs)), err
+}
+
+type routerCall struct {
+	to   common.Address
+	data []byte
+	gas  uint64
+}
+
+// calls returns the approvals the keeper is missing followed by the swaps.
+func (r *Router) calls(ctx context.Context, k *Keeper, ss []*routerSwap, now uint64) ([]routerCall, error) {
+	var cc []routerCall
+	approved := make(map[[2]common.Address]bool)
+
+	for _, s := range ss {
+		token := s.path[0]
+		if approved[[2]common.Address{token, s.router}] {
+			continue
+		}
+
+		t, err := erc20.NewTokenCaller(token, r.c)
+		if err != nil {
+			return nil, err
+		}
+
+		allowance, err := t.Allowance(&bind.CallOpts{Context: ctx}, k.Addr, s.router)
+		if err != nil {
+			return nil, errors.Wrap(err, "allowance "+token.Hex())
+		}
+
+		if allowance.Cmp(s.amountIn) < 0 {
+			data, err := r.erc20ABI.Pack("approve", s.router, math.MaxBig256)
+			if err != nil {
+				return nil, err
+			}
+			cc = append(cc, routerCall{to: token, data: data, gas: approveGas})
+		}
+		approved[[2]common.Address{token, s.router}] = true
+	}
+
+	deadline := new(big.Int).SetInt64(int64(now) + RouterDeadline)
+	for _, s := range ss {
+		data, err := r.routerABI.Pack("swapExactTokensForTokens", s.amountIn, s.amountOutMin, s.path, k.Addr, deadline)
+		if err != nil {
+			return nil, err
+		}
+		cc = append(cc, routerCall{to: s.router, data: data})
+	}
+
+	return cc, nil
+}
+
+// sign signs calls with consecutive nonces of k.
+func (r *Router) sign(k *Keeper, calls []routerCall, gas []uint64, baseFee, tip *big.Int) ([]*types.Transaction, error) {
+	txs := make([]*types.Transaction, len(calls))
+
+	for i, cl := range calls {
+		tx, err := r.M.newTxAt(k, k.nonce+uint64(i), cl.to, cl.data, gas[i], baseFee, tip, nil)
+		if err != nil {
+			return nil, err
+		}
+		txs[i] = tx
+	}
+
+	return txs, nil
+}
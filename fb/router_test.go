@@ -0,0 +1,84 @@
+package fb
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// doubler quotes twice the input for every hop of the path.
+type doubler struct{}
+
+func (doubler) GetAmountsOut(opts *bind.CallOpts, amountIn *big.Int, path []common.Address) ([]*big.Int, error) {
+	amts := []*big.Int{amountIn}
+	for range path[1:] {
+		amountIn = new(big.Int).Mul(amountIn, big.NewInt(2))
+		amts = append(amts, amountIn)
+	}
+	return amts, nil
+}
+
+type hopOuts []*big.Int
+
+func (h hopOuts) HopOuts(c *model.Cycle) ([]*big.Int, error) { return h, nil }
+
+func TestQuote(t *testing.T) {
+	defer func(s float64) { executor.Slippage = s }(executor.Slippage)
+	executor.Slippage = 0.01
+
+	r := &Router{
+		routers: map[model.AMM]common.Address{model.AMMUniswapV2: common.HexToAddress("0x1"), model.AMMSushiswap: common.HexToAddress("0x2")},
+		callers: map[model.AMM]amountsOuter{model.AMMUniswapV2: doubler{}, model.AMMSushiswap: doubler{}},
+	}
+
+	a, b := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+	c := model.NewCycle([]model.Half{{To: 0}, {To: 1}, {To: 2}}, 1.01, model.AMT1, 0)
+	// WETH -> a -> b on UNIV2, b -> WETH on SUSHI
+	c.SetParams([]common.Address{model.WETHAddress, a, b}, []model.AMM{model.AMMSushiswap, model.AMMUniswapV2, model.AMMUniswapV2})
+
+	amt := c.Amt.Int()
+	e := func(f float64) *big.Int { return mulf(amt, f) }
+
+	ss, err := r.quote(context.Background(), c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || len(ss[0].path) != 3 || ss[0].hop != 1 || ss[1].hop != 2 {
+		t.Fatalf("swaps %+v %+v", ss[0], ss[1])
+	}
+	// the routers' quotes less slippage, the second swap spends the first minimum
+	if ss[0].amountOut.Cmp(e(4)) != 0 || ss[0].amountOutMin.Cmp(e(3.96)) != 0 {
+		t.Errorf("router swap 0: out %s min %s", ss[0].amountOut, ss[0].amountOutMin)
+	}
+	if ss[1].amountIn.Cmp(ss[0].amountOutMin) != 0 || ss[1].amountOutMin.Cmp(mulf(new(big.Int).Mul(ss[1].amountIn, big.NewInt(2)), 0.99)) != 0 {
+		t.Errorf("router swap 1: in %s min %s", ss[1].amountIn, ss[1].amountOutMin)
+	}
+
+	r.SetSimulator(hopOuts{e(3), e(2), e(1.1)})
+
+	if ss, err = r.quote(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ss[0].amountOutMin.Cmp(e(1.98)) != 0 {
+		t.Errorf("sim swap 0: min %s, want %s", ss[0].amountOutMin, e(1.98))
+	}
+	// 1.1 for 2 simulated in, scaled to the 1.98 spent
+	want := new(big.Int).Div(new(big.Int).Mul(e(1.1), ss[0].amountOutMin), e(2))
+	if want = mulf(want, 0.99); ss[1].amountOutMin.Cmp(want) != 0 {
+		t.Errorf("sim swap 1: min %s, want %s", ss[1].amountOutMin, want)
+	}
+
+	// historic quotes cannot use the simulator's latest reserves
+	if ss, err = r.quote(context.Background(), c, big.NewInt(100)); err != nil {
+		t.Fatal(err)
+	}
+	if ss[0].amountOutMin.Cmp(e(3.96)) != 0 {
+		t.Errorf("historic swap 0: min %s", ss[0].amountOutMin)
+	}
+}
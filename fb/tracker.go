@@ -0,0 +1,214 @@
+package fb
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// TargetBlocks is how many consecutive blocks a bundle is submitted for.
+	TargetBlocks = 3
+
+	// Confirmations is how many blocks, counting the including one, must be
+	// on the canonical chain before an inclusion is reported.
+	Confirmations = 2
+)
+
+type Inclusion struct {
+	Block uint64
+	Hash  common.Hash
+	Tx    common.Hash
+}
+
+// bundle is the state of a submission that outlives a single eth_sendBundle.
+// Relays that support it replace or cancel everything sent under uuid.
+type bundle struct {
+	uuid   string
+	ret    float64
+	update chan float64
+
+	// rebuild signs a replacement of the bundle's txs, with the same
+	// nonces, for the cycle return r and the block target the replaced
+	// bundle was sent for.
+	rebuild func(r float64, target uint64) ([]*types.Transaction, error)
+}
+
+func newBundle(ret float64, rebuild func(float64, uint64) ([]*types.Transaction, error)) *bundle {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+
+	return &bundle{
+		uuid:    fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:]),
+		ret:     ret,
+		update:  make(chan float64, 1),
+		rebuild: rebuild,
+	}
+}
+
+// track submits the bundle txs for block first and, while it is not
+// included, again for each following block up to first+TargetBlocks-1. A return sent on
+// b.update replaces the bundle for the pending target. Once ctx is done the
+// bundle is cancelled and no more targets are submitted, but those already
+// sent are still watched.
+//
+// Inclusion is detected by scanning the bodies of new blocks for the last tx
+// of any version of the bundle. An inclusion that is reorged out before it has Confirmations is
+// dropped and watching resumes. A nil Inclusion means tx missed all of its
+// targets.
+func (m *MEV) track(ctx context.Context, k *Keeper, txs []*types.Transaction, first uint64, b *bundle) (*Inclusion, error) {
+	c := ethclient.NewClient(m.c)
+	log := m.log.WithFields(logrus.Fields{"tx": last(txs).Hash().Hex(), "keeper": k.Addr.Hex(), "uuid": b.uuid})
+
+	ch := make(chan *types.Header)
+	subs, err := c.SubscribeNewHead(context.Background(), ch)
+	if err != nil {
+		return nil, err
+	}
+	defer subs.Unsubscribe()
+
+	if err := m.sendBundle(ctx, txs, first, b.uuid); err != nil {
+		return nil, err
+	}
+
+	final := first + uint64(TargetBlocks) - 1
+	sent := first
+	versions := []*types.Transaction{last(txs)}
+
+	seen := map[common.Hash]bool{}
+	var hits []*Inclusion
+	var incl *Inclusion
+
+	done := ctx.Done()
+
+	for {
+		select {
+		case err := <-subs.Err():
+			return nil, err
+
+		case <-done:
+			done = nil
+			if err := m.cancelBundle(b.uuid); err != nil {
+				log.WithError(err).Warnln("cancel bundle")
+			} else {
+				log.Println("bundle cancelled")
+			}
+
+		case r := <-b.update:
+			if ctx.Err() != nil || incl != nil || b.rebuild == nil {
+				continue
+			}
+
+			ntxs, err := b.rebuild(r, sent)
+			if err != nil {
+				log.WithError(err).Warnln("replace bundle")
+				continue
+			}
+
+			if err := m.sendBundle(ctx, ntxs, sent, b.uuid); err != nil {
+				log.WithError(err).Warnf("replace bundle for block %d", sent)
+				continue
+			}
+
+			log.Printf("replaced bundle for block %d with %s, return %f", sent, last(ntxs).Hash().Hex(), r)
+			txs = ntxs
+			versions = append(versions, last(ntxs))
+
+		case h := <-ch:
+			n := h.Number.Uint64()
+
+			// walk back to the last block already scanned, this covers
+			// skipped heads as well as blocks of a new fork
+			for hash, bn := h.Hash(), n; bn >= first && !seen[hash]; bn-- {
+				blk, err := blockByHash(c, hash)
+				if err != nil {
+					return nil, err
+				}
+				seen[hash] = true
+
+				for _, t := range versions {
+					if blk.Transaction(t.Hash()) != nil {
+						hits = append(hits, &Inclusion{Block: bn, Hash: hash, Tx: t.Hash()})
+					}
+				}
+				hash = blk.ParentHash()
+			}
+
+			prev := incl
+			incl = nil
+			for _, hit := range hits {
+				ok, err := canonical(c, hit)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					incl = hit
+				}
+			}
+
+			switch {
+			case incl != nil && incl != prev:
+				log.Printf("included in block %d", incl.Block)
+			case incl == nil && prev != nil:
+				log.Warnf("inclusion in block %d reorged out", prev.Block)
+			}
+
+			if incl != nil {
+				if n+1 >= incl.Block+uint64(Confirmations) {
+					return incl, nil
+				}
+				continue
+			}
+
+			if n < sent {
+				continue
+			}
+
+			if n+1 > final || ctx.Err() != nil {
+				return nil, nil
+			}
+
+			sent = n + 1
+			if err := m.sendBundle(ctx, txs, sent, b.uuid); err != nil {
+				log.WithError(err).Warnf("resubmit for block %d", sent)
+			}
+		}
+	}
+}
+
+func last(txs []*types.Transaction) *types.Transaction {
+	return txs[len(txs)-1]
+}
+
+func canonical(c *ethclient.Client, incl *Inclusion) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	h, err := c.HeaderByNumber(ctx, new(big.Int).SetUint64(incl.Block))
+	if err != nil {
+		return false, errors.Wrapf(err, "header %d", incl.Block)
+	}
+
+	return h.Hash() == incl.Hash, nil
+}
+
+func blockByHash(c *ethclient.Client, hash common.Hash) (*types.Block, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	b, err := c.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "block %s", hash.Hex())
+	}
+	return b, nil
+}
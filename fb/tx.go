@@ -0,0 +1,193 @@
+package fb
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+type TxConfig struct {
+	// Legacy sends pre-London transactions (still EIP-155 signed) for
+	// chains without a base fee.
+	Legacy bool
+
+	// MaxFee caps the fee per gas. Zero means 2*baseFee + PriorityFee.
+	MaxFee      *big.Int
+	PriorityFee *big.Int
+
+	// GasMargin is applied to the gas the checker measured for the cycle;
+	// DefaultGas is used when there is no measurement.
+	GasMargin  float64
+	DefaultGas uint64
+}
+
+var DefaultTxConfig = TxConfig{
+	MaxFee:      new(big.Int),
+	PriorityFee: big.NewInt(2 * params.GWei),
+	GasMargin:   1.25,
+	DefaultGas:  1500000,
+}
+
+// Validate rejects a MaxFee below PriorityFee, nodes refuse txs whose fee
+// cap is below their tip.
+func (tc *TxConfig) Validate() error {
+	if tc.MaxFee != nil && tc.MaxFee.Sign() > 0 && tc.PriorityFee != nil && tc.MaxFee.Cmp(tc.PriorityFee) < 0 {
+		return fmt.Errorf("tx config: max fee %s below priority fee %s", tc.MaxFee, tc.PriorityFee)
+	}
+	return nil
+}
+
+func (tc *TxConfig) gasLimit(simulated uint64) uint64 {
+	if simulated == 0 {
+		return tc.DefaultGas
+	}
+
+	return uint64(float64(simulated) * tc.GasMargin)
+}
+
+func (tc *TxConfig) feeCap(baseFee *big.Int) *big.Int {
+	if tc.MaxFee != nil && tc.MaxFee.Sign() > 0 {
+		return tc.MaxFee
+	}
+
+	if baseFee == nil {
+		return tc.PriorityFee
+	}
+
+	return new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tc.PriorityFee)
+}
+
+// newTx builds and signs a call from k to to. baseFee is the base fee of the
+// latest header and may be nil on pre-London chains. A non nil tip overrides
+// the configured priority fee. Legacy txs with an access list are sent as
+// EIP-2930 txs.
+func (m *MEV) newTx(k *Keeper, to common.Address, data []byte, gas uint64, baseFee, tip *big.Int, al types.AccessList) (*types.Transaction, error) {
+	return m.newTxAt(k, k.nonce, to, data, gas, baseFee, tip, al)
+}
+
+// newTxAt is newTx for a nonce ahead of k's next one, for bundles of
+// several txs from the same keeper. A tip above the configured MaxFee is
+// lowered to it, the cap is the operator's.
+func (m *MEV) newTxAt(k *Keeper, nonce uint64, to common.Address, data []byte, gas uint64, baseFee, tip *big.Int, al types.AccessList) (*types.Transaction, error) {
+	tc := m.TxConfig
+	if tip != nil {
+		tc.PriorityFee = tip
+		if tc.MaxFee != nil && tc.MaxFee.Sign() > 0 && tc.MaxFee.Cmp(tip) < 0 {
+			tc.PriorityFee = tc.MaxFee
+		}
+	}
+
+	var rawTx *types.Transaction
+	if tc.Legacy || baseFee == nil {
+		gp := new(big.Int).Set(tc.PriorityFee)
+		if baseFee != nil {
+			gp.Add(gp, baseFee)
+		}
+		if tc.MaxFee != nil && tc.MaxFee.Sign() > 0 && gp.Cmp(tc.MaxFee) > 0 {
+			gp = tc.MaxFee
+		}
+
+		rawTx = legacyTx(m.chainID, nonce, tc.gasLimit(gas), to, data, gp, al)
+	} else {
+		rawTx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:    m.chainID,
+			Nonce:      nonce,
+			GasTipCap:  tc.PriorityFee,
+			GasFeeCap:  tc.feeCap(baseFee),
+			Gas:        tc.gasLimit(gas),
+			To:         &to,
+			Data:       data,
+			Value:      new(big.Int),
+			AccessList: al,
+		})
+	}
+
+	return k.signTx(rawTx, m.chainID)
+}
+
+func legacyTx(chainID *big.Int, nonce, gas uint64, to common.Address, data []byte, gp *big.Int, al types.AccessList) *types.Transaction {
+	if len(al) > 0 {
+		return types.NewTx(&types.AccessListTx{
+			ChainID:    chainID,
+			Nonce:      nonce,
+			Gas:        gas,
+			To:         &to,
+			Data:       data,
+			GasPrice:   gp,
+			Value:      new(big.Int),
+			AccessList: al,
+		})
+	}
+
+	return types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		Gas:      gas,
+		To:       &to,
+		Data:     data,
+		GasPrice: gp,
+		Value:    new(big.Int),
+	})
+}
+
+// keeperAccessList generates the access list of a call of data from k when
+// the checker simulated it from another account: what the executor reads
+// may depend on its caller, e.g. a keeper allowlist. al, the checker's list,
+// is kept if k is that account or the node cannot tell.
+func (m *MEV) keeperAccessList(ctx context.Context, k *Keeper, from common.Address, data []byte, gas uint64, al types.AccessList) types.AccessList {
+	if len(al) == 0 || k.Addr == from {
+		return al
+	}
+
+	kal, _, vmErr, err := gethclient.New(m.c).CreateAccessList(ctx, ethereum.CallMsg{
+		From: k.Addr,
+		To:   &m.toAddr,
+		Gas:  m.TxConfig.gasLimit(gas),
+		Data: data,
+	})
+	if err != nil || vmErr != "" || kal == nil {
+		m.log.WithField("keeper", k.Addr.Hex()).Warnln("access list:", err, vmErr)
+		return al
+	}
+
+	return *kal
+}
+
+// TransactOpts lets contract bindings send a tx from k with its next nonce.
+// The caller holds k and releases it with whether the tx was sent.
+func (m *MEV) TransactOpts(ctx context.Context, k *Keeper) (*bind.TransactOpts, error) {
+	opts := &bind.TransactOpts{
+		From:  k.Addr,
+		Nonce: new(big.Int).SetUint64(k.nonce),
+		Signer: func(a common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if a != k.Addr {
+				return nil, bind.ErrNotAuthorized
+			}
+			return k.signTx(tx, m.chainID)
+		},
+		Context: ctx,
+	}
+
+	if m.TxConfig.Legacy {
+		gp, err := ethclient.NewClient(m.c).SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts.GasPrice = gp
+		return opts, nil
+	}
+
+	opts.GasTipCap = m.TxConfig.PriorityFee
+	if m.TxConfig.MaxFee != nil && m.TxConfig.MaxFee.Sign() > 0 {
+		opts.GasFeeCap = m.TxConfig.MaxFee
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,523 @@
+// Package inventory follows what the executor and the keepers hold and keeps
+// it at the levels trading needs: WETH for the trades, ether for gas.
+package inventory
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/contracts/erc20"
+	"github.com/0xnibbler/mev-q4-2020/contracts/weth"
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/fb"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/tokens"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// TargetWETH is the WETH, in eth, the trading account is topped up to:
+	// the executor, or every keeper when they trade through the router.
+	TargetWETH = model.MaxLiveAMT.Float()
+
+	// MinKeeperETH is the least ether a keeper needs for gas. Below it the
+	// keeper's WETH is unwrapped, and nothing is traded until it has it.
+	MinKeeperETH = 0.05
+
+	// TargetKeeperETH is the ether a keeper keeps, what it has above this
+	// is wrapped when the trading account is short.
+	TargetKeeperETH = 0.2
+
+	// SweepThreshold is by how much, in eth, a balance has to exceed its
+	// target before the surplus is sent to Cold.
+	SweepThreshold = 1.0
+
+	// Cold receives swept profits. Nothing is swept while it is zero.
+	Cold common.Address
+
+	// RefreshInterval is how often balances are read from chain, besides
+	// after every rebalancing tx.
+	RefreshInterval = time.Minute
+
+	// MaxSteps limits the rebalancing txs sent per refresh.
+	MaxSteps = 4
+)
+
+const (
+	actionUnwrap    = "unwrap"
+	actionWrap      = "wrap"
+	actionFund      = "fund"
+	actionSweepETH  = "sweep_eth"
+	actionSweepWETH = "sweep_weth"
+	actionSweepExec = "sweep_executor"
+)
+
+// Manager tracks balances from Transfer events between periodic reads of
+// balanceOf and ether balances. Ether moved by WETH deposits and
+// withdrawals emits no Transfer and is only seen on the next read.
+type Manager struct {
+	c    *ethclient.Client
+	mev  *fb.MEV
+	enc  *executor.Encoder
+	tl   *tokens.List
+	weth *weth.WETH
+
+	executor common.Address
+	keepers  []common.Address
+
+	lock     sync.RWMutex
+	balances map[common.Address]map[common.Address]*big.Int
+	eth      map[common.Address]*big.Int
+	loaded   bool
+
+	noWithdraw sync.Once
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+// New returns a manager for mev's keepers and the executor of enc. With a
+// nil enc the keepers trade themselves through the router.
+func New(c *rpc.Client, mev *fb.MEV, enc *executor.Encoder, tl *tokens.List, m *metrics.Metrics) (*Manager, error) {
+	client := ethclient.NewClient(c)
+
+	w, err := weth.NewWETH(model.WETHAddress, client)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &Manager{
+		c:        client,
+		mev:      mev,
+		enc:      enc,
+		tl:       tl,
+		weth:     w,
+		keepers:  mev.Keepers.Addrs(),
+		balances: make(map[common.Address]map[common.Address]*big.Int),
+		eth:      make(map[common.Address]*big.Int),
+		metrics:  m,
+		log:      m.WithField("context", "Inventory"),
+	}
+	if enc != nil {
+		im.executor = enc.Address
+	}
+
+	for _, a := range im.holders() {
+		im.balances[a] = map[common.Address]*big.Int{model.WETHAddress: new(big.Int)}
+	}
+
+	return im, nil
+}
+
+func (m *Manager) holders() []common.Address {
+	aa := append([]common.Address(nil), m.keepers...)
+	if m.executor != (common.Address{}) {
+		aa = append(aa, m.executor)
+	}
+	return aa
+}
+
+func (m *Manager) Start(ctx context.Context) error {
+	if err := m.refresh(ctx); err != nil {
+		return errors.Wrap(err, "inventory: refresh")
+	}
+	m.rebalance(ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.tl.SubscribeTransfers(ctx, nil, m.holders(), m)
+	}()
+
+	t := time.NewTicker(RefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "inventory: transfers")
+		case <-t.C:
+			if err := m.refresh(ctx); err != nil {
+				m.log.WithError(err).Error("refresh")
+				continue
+			}
+			m.rebalance(ctx)
+		}
+	}
+}
+
+// Transfer implements tokens.TokenTransferSubsFn.
+func (m *Manager) Transfer(token common.Address, in bool, addr common.Address, amt *big.Int) {
+	m.lock.Lock()
+	b := m.balances[addr][token]
+	if b == nil {
+		b = new(big.Int)
+		m.balances[addr][token] = b
+	}
+	if in {
+		b.Add(b, amt)
+	} else {
+		b.Sub(b, amt)
+	}
+	v := m.units(token, b)
+	m.lock.Unlock()
+
+	m.metrics.MetricInventory(addr, token, v)
+}
+
+// refresh reads the ether of the keepers and every token balance seen so
+// far. Tokens that are gone, other than WETH, are forgotten.
+func (m *Manager) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	balances := make(map[common.Address]map[common.Address]*big.Int)
+	eth := make(map[common.Address]*big.Int)
+
+	for _, a := range m.keepers {
+		b, err := m.c.BalanceAt(ctx, a, nil)
+		if err != nil {
+			return errors.Wrap(err, "balance "+a.Hex())
+		}
+		eth[a] = b
+	}
+
+	m.lock.RLock()
+	held := make(map[common.Address][]common.Address)
+	for a, bb := range m.balances {
+		for t := range bb {
+			held[a] = append(held[a], t)
+		}
+	}
+	m.lock.RUnlock()
+
+	for a, tt := range held {
+		balances[a] = make(map[common.Address]*big.Int)
+		for _, t := range tt {
+			tc, err := erc20.NewTokenCaller(t, m.c)
+			if err != nil {
+				return err
+			}
+			b, err := tc.BalanceOf(&bind.CallOpts{Context: ctx}, a)
+			if err != nil {
+				return errors.Wrap(err, "balanceOf "+t.Hex())
+			}
+			if b.Sign() > 0 || t == model.WETHAddress {
+				balances[a][t] = b
+			}
+		}
+	}
+
+	m.lock.Lock()
+	m.balances, m.eth, m.loaded = balances, eth, true
+	m.lock.Unlock()
+
+	for a, bb := range balances {
+		for t, b := range bb {
+			m.metrics.MetricInventory(a, t, m.units(t, b))
+		}
+	}
+	for a, b := range eth {
+		m.metrics.MetricInventory(a, common.Address{}, weiToEth(b))
+	}
+
+	return nil
+}
+
+// units is b in whole tokens.
+func (m *Manager) units(token common.Address, b *big.Int) float64 {
+	dec := 18
+	if t := m.tl.ByAddr(token); t != nil {
+		dec = t.Decimals
+	}
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(b), new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(dec)), nil))).Float64()
+	return f
+}
+
+// Available is the WETH, in eth, one trade can use: the executor's, or
+// the least a keeper holds when the keepers trade themselves. Keepers are
+// picked round robin, so it is zero while any of them is short of gas.
+func (m *Manager) Available() float64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if !m.loaded {
+		return 0
+	}
+
+	gas := ethToWei(MinKeeperETH)
+	for _, k := range m.keepers {
+		if m.ethOf(k).Cmp(gas) < 0 {
+			return 0
+		}
+	}
+
+	if m.executor != (common.Address{}) {
+		return weiToEth(m.wethOf(m.executor))
+	}
+
+	avail := -1.0
+	for _, k := range m.keepers {
+		if w := weiToEth(m.wethOf(k)); avail < 0 || w < avail {
+			avail = w
+		}
+	}
+	return avail
+}
+
+// MaxAmt is the largest trade size inventory covers. ok is false if it
+// covers none.
+func (m *Manager) MaxAmt() (a model.AMT, ok bool) {
+	avail := m.Available()
+	for _, amt := range model.AllAmts {
+		if amt.Float() <= avail {
+			a, ok = amt, true
+		}
+	}
+	return a, ok
+}
+
+// Allow caps the size of live trades: cycles bigger than the inventory are
+// not run, the same path at a smaller amount, a cycle of its own, can be.
+// It is meant for the scheduler's live gate, detection and checks do not
+// depend on what is held.
+func (m *Manager) Allow(c *model.Cycle) bool {
+	a, ok := m.MaxAmt()
+	return ok && c.Amt <= a
+}
+
+func (m *Manager) wethOf(a common.Address) *big.Int {
+	if b := m.balances[a][model.WETHAddress]; b != nil {
+		return b
+	}
+	return new(big.Int)
+}
+
+func (m *Manager) ethOf(a common.Address) *big.Int {
+	if b := m.eth[a]; b != nil {
+		return b
+	}
+	return new(big.Int)
+}
+
+type step struct {
+	action string
+	from   common.Address
+	amt    *big.Int
+	send   func(opts *bind.TransactOpts) (*types.Transaction, error)
+}
+
+// rebalance sends the txs next asks for one at a time, reading balances
+// again after each.
+func (m *Manager) rebalance(ctx context.Context) {
+	for i := 0; i < MaxSteps; i++ {
+		s := m.next()
+		if s == nil {
+			return
+		}
+
+		log := m.log.WithFields(logrus.Fields{"action": s.action, "keeper": s.from.Hex(), "amount": weiToEth(s.amt)})
+		if err := m.send(ctx, s); err != nil {
+			log.WithError(err).Error("rebalance")
+			return
+		}
+		log.Println("rebalanced")
+
+		if err := m.refresh(ctx); err != nil {
+			m.log.WithError(err).Error("refresh")
+			return
+		}
+	}
+}
+
+// next picks the most urgent rebalancing tx: gas for the keepers first,
+// then trading inventory, then sweeping what is above target to Cold.
+func (m *Manager) next() *step {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if !m.loaded {
+		return nil
+	}
+
+	router := m.executor == (common.Address{})
+	target := ethToWei(TargetWETH)
+	keep := ethToWei(TargetKeeperETH)
+	threshold := ethToWei(SweepThreshold)
+
+	for _, k := range m.keepers {
+		if m.ethOf(k).Cmp(ethToWei(MinKeeperETH)) >= 0 {
+			continue
+		}
+
+		amt := min(m.wethOf(k), new(big.Int).Sub(keep, m.ethOf(k)))
+		if amt.Sign() <= 0 {
+			m.log.WithField("keeper", k.Hex()).Warnf("keeper has %.4f eth and no WETH to unwrap", weiToEth(m.ethOf(k)))
+			continue
+		}
+		return &step{action: actionUnwrap, from: k, amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+			return m.weth.Withdraw(opts, amt)
+		}}
+	}
+
+	if router {
+		for _, k := range m.keepers {
+			short := new(big.Int).Sub(target, m.wethOf(k))
+			spare := new(big.Int).Sub(m.ethOf(k), keep)
+			if amt := min(short, spare); amt.Sign() > 0 {
+				return m.wrap(k, amt)
+			}
+		}
+	} else if short := new(big.Int).Sub(target, m.wethOf(m.executor)); short.Sign() > 0 {
+		for _, k := range m.keepers {
+			if amt := min(short, m.wethOf(k)); amt.Sign() > 0 {
+				return &step{action: actionFund, from: k, amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+					return m.weth.Transfer(opts, m.executor, amt)
+				}}
+			}
+		}
+		for _, k := range m.keepers {
+			if amt := min(short, new(big.Int).Sub(m.ethOf(k), keep)); amt.Sign() > 0 {
+				return m.wrap(k, amt)
+			}
+		}
+	}
+
+	if Cold == (common.Address{}) {
+		return nil
+	}
+
+	for _, k := range m.keepers {
+		if amt := new(big.Int).Sub(m.ethOf(k), keep); amt.Cmp(threshold) > 0 {
+			return &step{action: actionSweepETH, from: k, amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+				opts.Value = amt
+				return bind.NewBoundContract(Cold, abi.ABI{}, m.c, m.c, m.c).Transfer(opts)
+			}}
+		}
+
+		amt := new(big.Int).Set(m.wethOf(k))
+		if router {
+			amt.Sub(amt, target)
+		}
+		if amt.Cmp(threshold) > 0 {
+			return &step{action: actionSweepWETH, from: k, amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+				return m.weth.Transfer(opts, Cold, amt)
+			}}
+		}
+	}
+
+	if router {
+		return nil
+	}
+
+	amt := new(big.Int).Sub(m.wethOf(m.executor), target)
+	if amt.Cmp(threshold) <= 0 {
+		return nil
+	}
+	if m.enc.Withdraw == "" {
+		m.noWithdraw.Do(func() {
+			m.log.Warnf("executor holds %.4f WETH above target but has no withdraw method", weiToEth(amt))
+		})
+		return nil
+	}
+
+	data, err := m.enc.PackWithdraw(model.WETHAddress, Cold, amt)
+	if err != nil {
+		m.log.WithError(err).Error("withdraw")
+		return nil
+	}
+	return &step{action: actionSweepExec, from: m.richest(), amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return bind.NewBoundContract(m.executor, abi.ABI{}, m.c, m.c, m.c).RawTransact(opts, data)
+	}}
+}
+
+func (m *Manager) wrap(k common.Address, amt *big.Int) *step {
+	return &step{action: actionWrap, from: k, amt: amt, send: func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		opts.Value = amt
+		return m.weth.Deposit(opts)
+	}}
+}
+
+// richest is the keeper with the most ether.
+func (m *Manager) richest() common.Address {
+	var r common.Address
+	var max *big.Int
+	for _, k := range m.keepers {
+		if max == nil || m.ethOf(k).Cmp(max) > 0 {
+			r, max = k, m.ethOf(k)
+		}
+	}
+	return r
+}
+
+// send has the keeper of s send its tx and holds the keeper until the tx
+// is mined, so trades do not queue behind it.
+func (m *Manager) send(ctx context.Context, s *step) error {
+	k, err := m.mev.Keepers.AcquireAddr(s.from)
+	if err != nil {
+		return err
+	}
+
+	opts, err := m.mev.TransactOpts(ctx, k)
+	if err != nil {
+		m.mev.Keepers.Release(k, false)
+		return err
+	}
+
+	tx, err := s.send(opts)
+	if err != nil {
+		m.mev.Keepers.Release(k, false)
+		m.metrics.MetricInventoryAction(s.action, false)
+		return err
+	}
+	defer m.mev.Keepers.Release(k, true)
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	r, err := bind.WaitMined(wctx, m.c, tx)
+	if err != nil {
+		m.metrics.MetricInventoryAction(s.action, false)
+		return errors.Wrap(err, "tx "+tx.Hash().Hex())
+	}
+
+	ok := r.Status == types.ReceiptStatusSuccessful
+	m.metrics.MetricInventoryAction(s.action, ok)
+	if !ok {
+		return errors.Errorf("tx %s reverted", tx.Hash().Hex())
+	}
+
+	return nil
+}
+
+func min(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return new(big.Int).Set(a)
+	}
+	return new(big.Int).Set(b)
+}
+
+func ethToWei(f float64) *big.Int {
+	w, _ := new(big.Float).Mul(big.NewFloat(f), big.NewFloat(1e18)).Int(nil)
+	return w
+}
+
+func weiToEth(w *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(w), big.NewFloat(1e18)).Float64()
+	return f
+}
@@ -0,0 +1,202 @@
+package journal
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/util"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+const File = "journal.jsonl"
+
+type Event string
+
+const (
+	EventDetected Event = "detected"
+	EventReturn   Event = "return"
+	EventTested   Event = "tested"
+	EventSent     Event = "sent"
+	EventIncluded Event = "included"
+	EventMissed   Event = "missed"
+	EventProfit   Event = "profit"
+)
+
+var AllEvents = []Event{EventDetected, EventReturn, EventTested, EventSent, EventIncluded, EventMissed, EventProfit}
+
+type Entry struct {
+	Time  time.Time `json:"time"`
+	Hash  uint64    `json:"hash"`
+	Event Event     `json:"event"`
+
+	Amt    float64          `json:"amt"`
+	Tokens []common.Address `json:"tokens,omitempty"`
+	AMMs   []model.AMM      `json:"amms,omitempty"`
+
+	Return     float64 `json:"return,omitempty"`
+	TestReturn float64 `json:"test_return,omitempty"`
+	Success    bool    `json:"success,omitempty"`
+	GasUsed    uint64  `json:"gas_used,omitempty"`
+	Block      uint64  `json:"block,omitempty"`
+	Profit     float64 `json:"profit,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Slippage   bool    `json:"slippage,omitempty"`
+
+	// Paper marks the runs of a paper trading process, nothing was sent.
+	Paper bool `json:"paper,omitempty"`
+
+	Explanation json.RawMessage `json:"explanation,omitempty"`
+}
+
+func (e *Entry) Len() int {
+	return len(e.Tokens)
+}
+
+// Run reports whether e is about a run of the cycle rather than its
+// detection or tests.
+func (e *Entry) Run() bool {
+	switch e.Event {
+	case EventSent, EventIncluded, EventMissed, EventProfit:
+		return true
+	}
+	return false
+}
+
+// Journal is an append-only log of everything the bot learns about a cycle,
+// keyed by model.Cycle.Hash(). A nil *Journal discards all entries.
+type Journal struct {
+	lock sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+
+	explainer explainer
+	paper     bool
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+type explainer interface {
+	JSON(c *model.Cycle) json.RawMessage
+}
+
+func Open(m *metrics.Metrics) (*Journal, error) {
+	f, err := util.OpenAppend(File)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		f:       f,
+		enc:     json.NewEncoder(f),
+		metrics: m,
+		log:     m.WithField("context", "Journal"),
+	}, nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.f.Close()
+}
+
+// SetExplainer adds e's breakdown of the cycle to successful tests and sent
+// entries.
+func (j *Journal) SetExplainer(e explainer) {
+	if j != nil {
+		j.explainer = e
+	}
+}
+
+// SetPaper marks the runs written from now on as paper trades.
+func (j *Journal) SetPaper(on bool) {
+	if j != nil {
+		j.paper = on
+	}
+}
+
+func (j *Journal) explain(c *model.Cycle) json.RawMessage {
+	if j == nil || j.explainer == nil {
+		return nil
+	}
+	return j.explainer.JSON(c)
+}
+
+func (j *Journal) Detected(c *model.Cycle) {
+	j.write(c, Entry{Event: EventDetected, Return: c.Return})
+}
+
+func (j *Journal) Return(c *model.Cycle, r float64) {
+	j.write(c, Entry{Event: EventReturn, Return: r})
+}
+
+func (j *Journal) Tested(c *model.Cycle, res *model.RunResult) {
+	e := Entry{Event: EventTested, Return: c.Return, Success: res.Success, TestReturn: res.Return, GasUsed: res.GasUsed}
+	if res.Error != nil {
+		e.Error = res.Error.Error()
+		e.Slippage = executor.IsSlippage(res.Error)
+	}
+	if res.Success {
+		e.Explanation = j.explain(c)
+	}
+	j.write(c, e)
+}
+
+func (j *Journal) Sent(c *model.Cycle, testReturn float64) {
+	j.write(c, Entry{Event: EventSent, Return: c.Return, TestReturn: testReturn, Explanation: j.explain(c)})
+}
+
+func (j *Journal) Result(c *model.Cycle, res *model.RunResult, err error) {
+	e := Entry{Event: EventMissed, Return: c.Return}
+	if res != nil {
+		e.Success, e.GasUsed, e.Block = res.Success, res.GasUsed, res.TargetBlock
+		if res.Success {
+			e.Event = EventIncluded
+		}
+		if err == nil && res.Error != nil {
+			err = res.Error
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+		e.Slippage = executor.IsSlippage(err)
+	}
+	j.write(c, e)
+}
+
+func (j *Journal) Profit(c *model.Cycle, block uint64, profit float64) {
+	j.write(c, Entry{Event: EventProfit, Block: block, Profit: profit})
+}
+
+func (j *Journal) write(c *model.Cycle, e Entry) {
+	if j == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Hash = c.Hash()
+	e.Amt = c.Amt.Float()
+	e.Tokens = c.ParamAddrs
+	e.AMMs = c.ParamAMMs
+	e.Paper = j.paper && e.Run()
+
+	j.lock.Lock()
+	err := j.enc.Encode(&e)
+	j.lock.Unlock()
+
+	if err != nil {
+		j.log.WithError(err).Errorln("write", e.Event, "hash =", e.Hash)
+		j.metrics.MetricJournalError()
+	}
+}
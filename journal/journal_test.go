@@ -0,0 +1,100 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testCycle(tokens ...common.Address) *model.Cycle {
+	hh := make([]model.Half, len(tokens))
+	aa := make([]model.AMM, len(tokens))
+	for i := range hh {
+		hh[i] = model.Half{To: int32(i)}
+		aa[i] = model.AMMUniswapV2
+	}
+	aa[0] = model.AMMSushiswap
+
+	c := model.NewCycle(hh, 1.01, model.AMT1, 0)
+	c.SetParams(tokens, aa)
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	a, b := common.HexToAddress("0xa"), common.HexToAddress("0xb")
+	c2 := testCycle(model.WETHAddress, a)
+	c3 := testCycle(model.WETHAddress, a, b)
+
+	var buf bytes.Buffer
+	j := &Journal{enc: json.NewEncoder(&buf)}
+
+	j.Detected(c2)
+	j.Detected(c3)
+	j.Tested(c2, &model.RunResult{Success: true, Return: 0.02, GasUsed: 150000})
+	j.Tested(c3, &model.RunResult{Error: errors.New("execution reverted")})
+	j.Sent(c2, 0.02)
+	j.Result(c2, &model.RunResult{Success: true, GasUsed: 140000, TargetBlock: 100}, nil)
+	j.Profit(c2, 100, 0.015)
+
+	j.SetPaper(true)
+	j.Sent(c2, 0.02)
+	j.Result(c2, &model.RunResult{TargetBlock: 101}, errors.New("not included"))
+
+	ee, err := read(bytes.NewReader(buf.Bytes()), Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ee) != 9 {
+		t.Fatalf("%d entries, want 9", len(ee))
+	}
+
+	if e := ee[5]; e.Event != EventIncluded || e.Hash != c2.Hash() || e.Block != 100 || e.GasUsed != 140000 || e.Paper {
+		t.Errorf("included entry %+v", e)
+	}
+	if e := ee[3]; e.Event != EventTested || e.Success || e.Error != "execution reverted" || e.Len() != 3 || e.Tokens[2] != b {
+		t.Errorf("tested entry %+v", e)
+	}
+	if e := ee[8]; e.Event != EventMissed || !e.Paper || e.Error != "not included" {
+		t.Errorf("paper entry %+v", e)
+	}
+
+	live, paper := false, true
+	sushi := model.AMMSushiswap
+	for _, tc := range []struct {
+		name string
+		f    Filter
+		want int
+	}{
+		{"hash", Filter{Hash: c3.Hash()}, 2},
+		{"events", Filter{Events: []Event{EventSent, EventIncluded}}, 3},
+		{"token", Filter{Token: b}, 2},
+		{"amm", Filter{AMM: &sushi}, 9},
+		{"len", Filter{Len: 2}, 7},
+		{"since", Filter{Since: time.Now().Add(time.Hour)}, 0},
+		{"live", Filter{Paper: &live}, 7},
+		{"paper", Filter{Paper: &paper}, 6},
+		{"paper runs", Filter{Paper: &paper, Events: []Event{EventSent, EventMissed}}, 2},
+	} {
+		ee, err := read(bytes.NewReader(buf.Bytes()), tc.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ee) != tc.want {
+			t.Errorf("%s: %d entries, want %d", tc.name, len(ee), tc.want)
+		}
+	}
+
+	ss := Summarize(ee)
+	if len(ss) != 2 || ss[0].Hash != c2.Hash() {
+		t.Fatalf("summaries %+v", ss)
+	}
+	if s := ss[0]; s.Detected != 1 || s.TestedOK != 1 || s.Sent != 2 || s.Included != 1 || s.Profit != 0.015 || s.HitRate() != 0.5 {
+		t.Errorf("summary %+v", s)
+	}
+}
@@ -0,0 +1,288 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/util"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+type Filter struct {
+	Hash   uint64
+	Events []Event
+	Token  common.Address
+	AMM    *model.AMM
+	Len    int
+	Since  time.Time
+
+	// Paper, when set, keeps only the runs of that mode. Detections and
+	// tests are kept either way.
+	Paper *bool
+}
+
+func (f *Filter) Match(e *Entry) bool {
+	if f.Hash != 0 && e.Hash != f.Hash {
+		return false
+	}
+
+	if f.Len != 0 && e.Len() != f.Len {
+		return false
+	}
+
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+
+	if f.Paper != nil && e.Run() && e.Paper != *f.Paper {
+		return false
+	}
+
+	if len(f.Events) > 0 {
+		found := false
+		for _, ev := range f.Events {
+			if ev == e.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Token != model.ZeroAddress {
+		found := false
+		for _, t := range e.Tokens {
+			if t == f.Token {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.AMM != nil {
+		found := false
+		for _, a := range e.AMMs {
+			if a == *f.AMM {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func Read(f Filter) ([]*Entry, error) {
+	file, err := os.Open(util.Path(File))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return read(file, f)
+}
+
+func read(r io.Reader, f Filter) ([]*Entry, error) {
+	var ee []*Entry
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		e := &Entry{}
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			return ee, errors.Wrap(err, "journal: line "+strconv.Itoa(n))
+		}
+
+		if f.Match(e) {
+			ee = append(ee, e)
+		}
+	}
+
+	return ee, sc.Err()
+}
+
+func WriteJSONL(w io.Writer, ee []*Entry) error {
+	enc := json.NewEncoder(w)
+	for _, e := range ee {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var csvHeader = []string{"time", "hash", "event", "amt", "len", "tokens", "amms",
+	"return", "test_return", "success", "gas_used", "block", "profit", "error", "paper"}
+
+func WriteCSV(w io.Writer, ee []*Entry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, e := range ee {
+		tt := make([]string, len(e.Tokens))
+		for i, t := range e.Tokens {
+			tt[i] = t.Hex()
+		}
+		aa := make([]string, len(e.AMMs))
+		for i, a := range e.AMMs {
+			aa[i] = a.String()
+		}
+
+		if err := cw.Write([]string{
+			e.Time.Format(time.RFC3339Nano),
+			strconv.FormatUint(e.Hash, 10),
+			string(e.Event),
+			fmtFloat(e.Amt),
+			strconv.Itoa(e.Len()),
+			strings.Join(tt, "|"),
+			strings.Join(aa, "|"),
+			fmtFloat(e.Return),
+			fmtFloat(e.TestReturn),
+			strconv.FormatBool(e.Success),
+			strconv.FormatUint(e.GasUsed, 10),
+			strconv.FormatUint(e.Block, 10),
+			fmtFloat(e.Profit),
+			e.Error,
+			strconv.FormatBool(e.Paper),
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func fmtFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+type Summary struct {
+	Hash   uint64           `json:"hash"`
+	Amt    float64          `json:"amt"`
+	Tokens []common.Address `json:"tokens"`
+	AMMs   []model.AMM      `json:"amms"`
+
+	Detected  int     `json:"detected"`
+	Tested    int     `json:"tested"`
+	TestedOK  int     `json:"tested_ok"`
+	Sent      int     `json:"sent"`
+	Included  int     `json:"included"`
+	MaxReturn float64 `json:"max_return"`
+	Profit    float64 `json:"profit"`
+}
+
+func (s *Summary) HitRate() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Included) / float64(s.Sent)
+}
+
+// Summarize folds entries into one Summary per cycle hash, sorted by realized
+// profit and then by the number of bundles sent.
+func Summarize(ee []*Entry) []*Summary {
+	m := make(map[uint64]*Summary)
+	for _, e := range ee {
+		s, ok := m[e.Hash]
+		if !ok {
+			s = &Summary{Hash: e.Hash, Amt: e.Amt, Tokens: e.Tokens, AMMs: e.AMMs}
+			m[e.Hash] = s
+		}
+
+		if e.Return > s.MaxReturn {
+			s.MaxReturn = e.Return
+		}
+
+		switch e.Event {
+		case EventDetected:
+			s.Detected++
+		case EventTested:
+			s.Tested++
+			if e.Success {
+				s.TestedOK++
+			}
+		case EventSent:
+			s.Sent++
+		case EventIncluded:
+			s.Included++
+		case EventProfit:
+			s.Profit += e.Profit
+		}
+	}
+
+	ss := make([]*Summary, 0, len(m))
+	for _, s := range m {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].Profit != ss[j].Profit {
+			return ss[i].Profit > ss[j].Profit
+		}
+		return ss[i].Sent > ss[j].Sent
+	})
+
+	return ss
+}
+
+var summaryCSVHeader = []string{"hash", "amt", "len", "tokens", "amms", "detected", "tested", "tested_ok",
+	"sent", "included", "hit_rate", "max_return", "profit"}
+
+func WriteSummaryCSV(w io.Writer, ss []*Summary) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(summaryCSVHeader); err != nil {
+		return err
+	}
+
+	for _, s := range ss {
+		tt := make([]string, len(s.Tokens))
+		for i, t := range s.Tokens {
+			tt[i] = t.Hex()
+		}
+		aa := make([]string, len(s.AMMs))
+		for i, a := range s.AMMs {
+			aa[i] = a.String()
+		}
+
+		if err := cw.Write([]string{
+			strconv.FormatUint(s.Hash, 10),
+			fmtFloat(s.Amt),
+			strconv.Itoa(len(s.Tokens)),
+			strings.Join(tt, "|"),
+			strings.Join(aa, "|"),
+			strconv.Itoa(s.Detected),
+			strconv.Itoa(s.Tested),
+			strconv.Itoa(s.TestedOK),
+			strconv.Itoa(s.Sent),
+			strconv.Itoa(s.Included),
+			fmtFloat(s.HitRate()),
+			fmtFloat(s.MaxReturn),
+			fmtFloat(s.Profit),
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/journal"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// journalCmd queries the journal and exports the matching entries:
+//
+//	mev journal [-format jsonl|csv] [-summary] [-o file] [-hash h] [-event e,..] [-token addr] [-amm UNIV2] [-len n] [-since 24h] [-mode live|paper]
+func journalCmd(args []string) error {
+	fs := flag.NewFlagSet("journal", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "output format: jsonl or csv")
+	summary := fs.Bool("summary", false, "aggregate per cycle hash (hit rate, profit)")
+	out := fs.String("o", "", "output file (default stdout)")
+	hash := fs.String("hash", "", "cycle hash")
+	events := fs.String("event", "", "comma separated events ("+eventNames()+")")
+	token := fs.String("token", "", "token address")
+	amm := fs.String("amm", "", "amm name or id")
+	length := fs.Int("len", 0, "cycle length")
+	since := fs.Duration("since", 0, "only entries newer than this")
+	mode := fs.String("mode", "", "only runs of this mode: live or paper")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var f journal.Filter
+
+	if *hash != "" {
+		h, err := strconv.ParseUint(*hash, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad hash %q", *hash)
+		}
+		f.Hash = h
+	}
+
+	if *events != "" {
+		for _, e := range strings.Split(*events, ",") {
+			f.Events = append(f.Events, journal.Event(strings.TrimSpace(e)))
+		}
+	}
+
+	if *token != "" {
+		if !common.IsHexAddress(*token) {
+			return fmt.Errorf("bad token address %q", *token)
+		}
+		f.Token = common.HexToAddress(*token)
+	}
+
+	if *amm != "" {
+		a, ok := model.ParseAMM(*amm)
+		if !ok {
+			return fmt.Errorf("bad amm %q", *amm)
+		}
+		f.AMM = &a
+	}
+
+	f.Len = *length
+
+	if *since > 0 {
+		f.Since = time.Now().Add(-*since)
+	}
+
+	switch *mode {
+	case "":
+	case "live", "paper":
+		paper := *mode == "paper"
+		f.Paper = &paper
+	default:
+		return fmt.Errorf("bad mode %q", *mode)
+	}
+
+	ee, err := journal.Read(f)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch {
+	case *summary && *format == "csv":
+		return journal.WriteSummaryCSV(w, journal.Summarize(ee))
+	case *summary:
+		enc := json.NewEncoder(w)
+		for _, s := range journal.Summarize(ee) {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *format == "csv":
+		return journal.WriteCSV(w, ee)
+	case *format == "jsonl":
+		return journal.WriteJSONL(w, ee)
+	}
+
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func eventNames() string {
+	var ss []string
+	for _, e := range journal.AllEvents {
+		ss = append(ss, string(e))
+	}
+	return strings.Join(ss, ",")
+}
@@ -3,21 +3,34 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"math/big"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/0xnibbler/mev-q4-2020/algo"
 	"github.com/0xnibbler/mev-q4-2020/amm"
+	"github.com/0xnibbler/mev-q4-2020/calibration"
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/explain"
 	"github.com/0xnibbler/mev-q4-2020/fb"
+	"github.com/0xnibbler/mev-q4-2020/inventory"
+	"github.com/0xnibbler/mev-q4-2020/journal"
 	"github.com/0xnibbler/mev-q4-2020/metrics"
 	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/paper"
+	"github.com/0xnibbler/mev-q4-2020/pnl"
+	"github.com/0xnibbler/mev-q4-2020/risk"
 	"github.com/0xnibbler/mev-q4-2020/scheduler"
+	"github.com/0xnibbler/mev-q4-2020/signer"
 	"github.com/0xnibbler/mev-q4-2020/tokens"
 	"github.com/0xnibbler/mev-q4-2020/util"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -29,11 +42,62 @@ var (
 	flagLoad    = flag.Bool("load", true, "load new tokens (default=true)")
 	flagMetrics = flag.Bool("metrics", false, "metrics (default=false)")
 	flagLive    = flag.Bool("live", true, "live (default=true)")
+	flagPaper   = flag.Bool("paper", true, "paper trade when not live (default=true)")
 	flagIPC     = flag.String("ipc", "", "ipc path")
+	flagKeepers = flag.String("keepers", "privatekey.json", "comma separated keeper signers (keystore file or external:<endpoint>@<addr>)")
+	flagAuth    = flag.String("auth", fb.AuthSigner, "relay auth signer, a missing keystore is created")
+	flagPass    = flag.String("passphrase", signer.Passphrase, "keystore passphrase source: env:<NAME>, file:<path> or fd:<n>")
+	flagExec    = flag.String("executor", "executor.json", "executor contract definition")
+	flagLegacy  = flag.Bool("legacy", false, "send legacy (pre-London) transactions")
+	flagMaxFee  = flag.Float64("max-fee", 0, "max fee per gas in gwei (0 = 2*basefee+priority)")
+	flagTipFee  = flag.Float64("priority-fee", 2, "priority fee per gas in gwei")
+	flagSubmit  = flag.String("submit", "flashbots", "live submission: flashbots (bundles), public (mempool) or router (Router02 bundles, no executor contract)")
+	flagAccess  = flag.Bool("access-lists", true, "generate access lists for executor txs (default=true)")
+	flagRelays  = flag.String("relays", "", "relay list file (default flashbots relay)")
+	flagBribe   = flag.String("bribe", "coinbase", "bribe payment: coinbase (via executor) or priority-fee")
+	flagShare   = flag.Float64("bribe-share", 0.5, "initial share of simulated profit paid as bribe")
+	flagMinProf = flag.Float64("min-profit", 0, "min eth_callBundle profit in gwei after bribe and gas")
+	flagTargets = flag.Int("target-blocks", 3, "number of consecutive blocks a bundle is submitted for")
+	flagConfirm = flag.Int("confirmations", 2, "blocks on top of an inclusion, counting itself, before it is reported")
+	flagAllowTg = flag.String("allow-tags", "", "comma separated token list tags, only tokens with one of them are traded")
+	flagDenyTgs = flag.String("deny-tags", "", "comma separated token list tags of tokens never traded")
+	flagOwnerCt = flag.Bool("exclude-owner-controlled", true, "skip cycles through tokens whose owner can pause, blacklist, change fees or upgrade (default=true)")
+	flagCold    = flag.String("cold", "", "address profits above target are swept to (default no sweeping)")
+	flagTgtWETH = flag.Float64("target-weth", inventory.TargetWETH, "WETH the executor (or each keeper with -submit router) is topped up to")
+	flagKeepETH = flag.Float64("keeper-eth", inventory.TargetKeeperETH, "ether a keeper keeps for gas, the rest may be wrapped")
+	flagSweep   = flag.Float64("sweep-threshold", inventory.SweepThreshold, "eth above target before a balance is swept to -cold")
+	flagSlip    = flag.Float64("slippage", executor.Slippage, "share each hop may return below the exact simulation before the executor, or a router swap, reverts")
+	flagRiskNtl = flag.Float64("max-notional", risk.DefaultLimits.MaxNotional, "max eth per live trade")
+	flagRiskTrd = flag.Int("max-trades-hour", risk.DefaultLimits.MaxTradesPerHour, "max live trades per hour (0 = no limit)")
+	flagRiskGas = flag.Uint64("max-gas-day", risk.DefaultLimits.MaxGasPerDay, "max gas mined per day (0 = no limit)")
+	flagRiskSpd = flag.Float64("max-spend-day", risk.DefaultLimits.MaxSpendPerDay, "max eth spent on gas and coinbase payments per day (0 = no limit)")
+	flagRiskLss = flag.Float64("max-loss-day", risk.DefaultLimits.MaxLossPerDay, "max realized eth loss per day before the breaker trips (0 = no limit)")
+	flagRiskFls = flag.Int("max-failures", risk.DefaultLimits.MaxConsecutiveFailures, "consecutive failed inclusions before the breaker trips (0 = no limit)")
+	flagRiskTok = flag.String("risk-token", "", "X-Risk-Token a POST /risk needs to reset the breaker (default: only from localhost)")
 )
 
 func main() {
 	flag.Parse()
+
+	if flag.Arg(0) == "journal" {
+		if err := journalCmd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "journal:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "tokenlist" {
+		if err := tokenListCmd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, "tokenlist:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	tokens.AllowTags = splitTags(*flagAllowTg)
+	tokens.DenyTags = splitTags(*flagDenyTgs)
+
 	metrics.On = *flagMetrics
 
 	go func() {
@@ -99,7 +163,12 @@ func main() {
 		u := amm.NewUniswapV2(amm.NewConfig(c, p, tl, m))
 		s := amm.NewSushiswap(amm.NewConfig(c, p, tl, m))
 
-		if err := util.PullAll(ctx, client, tl, u, s); err != nil {
+		scanner, err := tokens.NewScanner(c)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := util.PullAll(ctx, client, tl, scanner, u, s, m.WithField("context", "Pull")); err != nil {
 			panic(err)
 		}
 
@@ -112,6 +181,16 @@ func main() {
 	}
 }
 
+func gwei(f float64) *big.Int {
+	w, _ := new(big.Float).Mul(big.NewFloat(f), big.NewFloat(params.GWei)).Int(nil)
+	return w
+}
+
+type execer interface {
+	Running() bool
+	Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error)
+}
+
 func run(ctx context.Context, c *rpc.Client, m *metrics.Metrics) error {
 	client := ethclient.NewClient(c)
 
@@ -124,6 +203,8 @@ func run(ctx context.Context, c *rpc.Client, m *metrics.Metrics) error {
 
 	_ = failedAmts
 
+	tokens.ExcludeOwnerControlled = *flagOwnerCt
+
 	p := algo.NewPrices(model.AmtThreshs, m)
 	tl.AmtGetter = p
 
@@ -131,6 +212,8 @@ func run(ctx context.Context, c *rpc.Client, m *metrics.Metrics) error {
 
 	s := amm.NewSushiswap(conf)
 	u := amm.NewUniswapV2(conf)
+	sim := amm.NewSimulator(u, s)
+	p.SetExact(sim)
 	//crv := amm.NewCurve(conf)
 	//u1 := amm.NewUniswapV1(conf)
 
@@ -167,15 +250,163 @@ func run(ctx context.Context, c *rpc.Client, m *metrics.Metrics) error {
 		return subsHeadPrices(ctx, client, headCh, u, s)
 	})
 
-	var x *fb.Exec
+	errg.Go(func() error {
+		if err := tl.Analyse(ctx, tokens.NewAnalyser(client), false); err != nil && ctx.Err() == nil {
+			m.WithError(err).Error("tokens: analyse")
+		}
+		return nil
+	})
+
+	var enc *executor.Encoder
+	var toAddr common.Address
+	load := *flagSubmit != "router"
+	if load && !*flagLive {
+		// paper trading sends nothing, without a definition cycles are
+		// checked through the router
+		if _, err := os.Stat(*flagExec); os.IsNotExist(err) {
+			m.Warnln("executor: no definition, checking cycles through the router")
+			load = false
+		}
+	}
+	if load {
+		if enc, err = executor.Load(*flagExec); err != nil {
+			return errors.Wrap(err, "executor")
+		}
+		toAddr = enc.Address
+		enc.SetSimulator(sim)
+	}
+	executor.Slippage = *flagSlip
+
+	var x execer
+	var px *paper.Exec
+	var rt *fb.Router
+	var g *risk.Guard
+	var inv *inventory.Manager
 	if *flagLive {
-		x = &fb.Exec{
-			M: fb.New(c, common.HexToAddress("")),
+		signer.Passphrase = *flagPass
+		fb.KeeperSigners = strings.Split(*flagKeepers, ",")
+		fb.AuthSigner = *flagAuth
+		mev := fb.New(c, toAddr, m)
+		if *flagRelays != "" {
+			if mev.Relays, err = fb.LoadRelays(*flagRelays); err != nil {
+				return errors.Wrap(err, "relays")
+			}
+		}
+
+		mev.TxConfig.Legacy = *flagLegacy
+		mev.TxConfig.MaxFee = gwei(*flagMaxFee)
+		mev.TxConfig.PriorityFee = gwei(*flagTipFee)
+		if err := mev.TxConfig.Validate(); err != nil {
+			return err
+		}
+		fb.MinProfit = gwei(*flagMinProf)
+		fb.TargetBlocks = *flagTargets
+		fb.Confirmations = *flagConfirm
+
+		mode := fb.BribeCoinbase
+		if *flagBribe == "priority-fee" {
+			mode = fb.BribePriorityFee
+		} else if enc != nil && !enc.Has("bribe") {
+			m.Warnln("bribe: executor has no bribe arg, coinbase payments are dropped")
+		}
+		mev.Bribe = fb.NewBribe(mode, *flagShare, m)
+		errg.Go(func() error {
+			return errors.Wrap(mev.Start(ctx), "keepers")
+		})
+
+		if *flagCold != "" {
+			if !common.IsHexAddress(*flagCold) {
+				return errors.New("cold: not an address")
+			}
+			inventory.Cold = common.HexToAddress(*flagCold)
+		}
+		inventory.TargetWETH = *flagTgtWETH
+		inventory.TargetKeeperETH = *flagKeepETH
+		inventory.SweepThreshold = *flagSweep
+		if inv, err = inventory.New(c, mev, enc, tl, m); err != nil {
+			return errors.Wrap(err, "inventory")
 		}
+		errg.Go(func() error {
+			return inv.Start(ctx)
+		})
+
+		var lx execer
+		switch *flagSubmit {
+		case "public":
+			lx = &fb.Public{M: mev, Enc: enc}
+		case "router":
+			if rt, err = fb.NewRouter(c, mev); err != nil {
+				return errors.Wrap(err, "router")
+			}
+			rt.SetSimulator(sim)
+			lx = rt
+		default:
+			lx = &fb.Exec{M: mev, Enc: enc}
+		}
+
+		risk.ResetToken = *flagRiskTok
+		g = risk.New(lx, risk.Limits{
+			MaxNotional:            *flagRiskNtl,
+			MaxTradesPerHour:       *flagRiskTrd,
+			MaxGasPerDay:           *flagRiskGas,
+			MaxSpendPerDay:         *flagRiskSpd,
+			MaxLossPerDay:          *flagRiskLss,
+			MaxConsecutiveFailures: *flagRiskFls,
+		}, m)
+		m.Handle("/risk", g)
+		x = g
+	} else if *flagPaper {
+		if px, err = paper.New(c, m); err != nil {
+			return errors.Wrap(err, "paper")
+		}
+		x = px
 	}
-	scheduler.Live = *flagLive
+	scheduler.Live = *flagLive || *flagPaper
+	scheduler.AccessLists = *flagAccess
 
-	sc := scheduler.New(c, x, m)
+	if enc == nil && rt == nil {
+		if rt, err = fb.NewRouter(c, nil); err != nil {
+			return errors.Wrap(err, "router")
+		}
+	}
+
+	j, err := journal.Open(m)
+	if err != nil {
+		return errors.Wrap(err, "journal")
+	}
+	defer j.Close()
+	j.SetPaper(px != nil)
+
+	ex := explain.New(client, sim, tl)
+	j.SetExplainer(ex)
+
+	sc := scheduler.New(c, x, enc, j, m)
+	sc.SetExplainer(ex)
+	if g != nil {
+		g.OnTrip = func(string) { sc.SetLive(false) }
+		g.OnReset = func() { sc.SetLive(true) }
+	}
+	if enc == nil {
+		sc.SetChecker(rt)
+	}
+	sc.AddFilter(tl)
+	if inv != nil {
+		sc.AddLiveFilter(inv)
+	}
+
+	cal := calibration.New(m)
+	m.Handle("/calibration", cal)
+	sc.SetCalibrator(cal)
+
+	rc := pnl.New(c, toAddr, j, m)
+	if g != nil {
+		rc.SetRealizer(g)
+	}
+	rc.SetCalibrator(cal)
+	sc.SetReconciler(rc)
+	if px != nil {
+		px.SetSimulator(sc)
+	}
 
 	errg.Go(func() error {
 		return errors.Wrap(sc.Start(ctx), "scheduler")
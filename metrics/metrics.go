@@ -27,6 +27,7 @@ var (
 
 type Metrics struct {
 	server *http.Server
+	mux    *http.ServeMux
 	lHook  *logrusHook
 	logrus.FieldLogger
 
@@ -34,6 +35,23 @@ type Metrics struct {
 	cycleUpdates *prometheus.GaugeVec
 	gasPrice     *prometheus.GaugeVec
 	cycleDur     *prometheus.GaugeVec
+	risk         *prometheus.GaugeVec
+	paper        *prometheus.GaugeVec
+	bribe        *prometheus.GaugeVec
+	bribes       *prometheus.CounterVec
+	relays       *prometheus.CounterVec
+	public       *prometheus.CounterVec
+	accessLists  *prometheus.CounterVec
+	accessGas    *prometheus.CounterVec
+	pnl          *prometheus.GaugeVec
+	pnlTrades    *prometheus.CounterVec
+	inventory    *prometheus.GaugeVec
+	invActions   *prometheus.CounterVec
+	calib        *prometheus.HistogramVec
+	calibToken   *prometheus.HistogramVec
+	exact        *prometheus.CounterVec
+	reverts      *prometheus.CounterVec
+	journalErrs  prometheus.Counter
 }
 
 func New() *Metrics {
@@ -72,9 +90,161 @@ func New() *Metrics {
 			},
 			[]string{"q"},
 		),
+
+		risk: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "risk",
+				Name:      "state",
+				Help:      "Risk limit usage and circuit breaker state",
+			},
+			[]string{"name"},
+		),
+
+		paper: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "paper",
+				Name:      "state",
+				Help:      "Paper trading hypothetical pnl and counters",
+			},
+			[]string{"name"},
+		),
 	}
 
-	prometheus.MustRegister(m.poolUpdates, m.cycleUpdates, m.gasPrice, m.cycleDur)
+	m.bribe = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "bribe",
+			Name:      "state",
+			Help:      "Bribe share of profit, last amount (eth) and lowest included share",
+		},
+		[]string{"mode", "name"},
+	)
+	m.bribes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "bribe",
+			Name:      "outcomes_total",
+			Help:      "Bundles by bribe mode and inclusion",
+		},
+		[]string{"mode", "included"},
+	)
+
+	m.relays = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "relay",
+			Name:      "requests_total",
+			Help:      "Relay requests by relay, method and acceptance",
+		},
+		[]string{"relay", "method", "accepted"},
+	)
+
+	m.public = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "public",
+			Name:      "txs_total",
+			Help:      "Public mempool submissions by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	m.accessLists = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "access_list",
+			Name:      "checks_total",
+			Help:      "Access lists generated by cycle length and whether they saved gas",
+		},
+		[]string{"len", "used"},
+	)
+	m.accessGas = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "access_list",
+			Name:      "saved_gas_total",
+			Help:      "Gas saved by access lists by cycle length",
+		},
+		[]string{"len"},
+	)
+
+	m.pnl = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "pnl",
+			Name:      "eth",
+			Help:      "Realized vs predicted profit of the last trade and in total, gross and net of gas and coinbase payments",
+		},
+		[]string{"name"},
+	)
+	m.pnlTrades = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pnl",
+			Name:      "trades_total",
+			Help:      "Reconciled trades by result",
+		},
+		[]string{"result"},
+	)
+
+	m.inventory = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "inventory",
+			Name:      "balance",
+			Help:      "Executor and keeper balances by token, in token units",
+		},
+		[]string{"holder", "token"},
+	)
+	m.invActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "inventory",
+			Name:      "actions_total",
+			Help:      "Rebalancing txs by action and success",
+		},
+		[]string{"action", "success"},
+	)
+
+	// return errors, i.e. profit per unit traded, around zero
+	calibBuckets := []float64{-0.05, -0.02, -0.01, -0.005, -0.002, -0.001, -0.0005, 0, 0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05}
+	m.calib = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "calibration",
+			Name:      "return_error",
+			Help:      "Return error of a later estimate against an earlier one by path length, AMM mix and size",
+			Buckets:   calibBuckets,
+		},
+		[]string{"stage", "len", "amms", "amt"},
+	)
+	m.calibToken = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "calibration",
+			Name:      "token_return_error",
+			Help:      "Return error of a later estimate against an earlier one by trusted token in the cycle, other tokens together",
+			Buckets:   calibBuckets,
+		},
+		[]string{"stage", "token"},
+	)
+
+	m.exact = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cycles",
+			Name:      "exact_total",
+			Help:      "New cycles by amount and whether the exact simulation kept them",
+		},
+		[]string{"amt", "kept"},
+	)
+
+	m.reverts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cycles",
+			Name:      "reverts_total",
+			Help:      "Reverted checks and live runs by whether a minimum output was missed",
+		},
+		[]string{"path", "slippage"},
+	)
+
+	m.journalErrs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "journal",
+			Name:      "write_errors_total",
+			Help:      "Journal entries that could not be written",
+		},
+	)
+
+	prometheus.MustRegister(m.poolUpdates, m.cycleUpdates, m.gasPrice, m.cycleDur, m.risk, m.paper, m.bribe, m.bribes, m.relays, m.public,
+		m.accessLists, m.accessGas, m.pnl, m.pnlTrades, m.inventory, m.invActions, m.calib, m.calibToken, m.exact, m.reverts, m.journalErrs)
 
 	m.Start()
 	return m
@@ -104,10 +274,10 @@ func (m *Metrics) Start() error {
 
 	m.FieldLogger = logger
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	m.mux = http.NewServeMux()
+	m.mux.Handle("/metrics", promhttp.Handler())
 
-	m.server = &http.Server{Addr: promPort, Handler: mux}
+	m.server = &http.Server{Addr: promPort, Handler: m.mux}
 	go m.server.ListenAndServe()
 
 	return nil
@@ -118,6 +288,10 @@ func (m *Metrics) Stop() error {
 	return m.server.Shutdown(context.Background())
 }
 
+func (m *Metrics) Handle(pattern string, h http.Handler) {
+	m.mux.Handle(pattern, h)
+}
+
 func (m *Metrics) MetricPoolUpdate(a model.AMM, p common.Address) {
 	m.preMetric(func() {
 		m.poolUpdates.WithLabelValues(a.String(), p.String()).Inc()
@@ -144,6 +318,109 @@ func (m *Metrics) MetricCycleDur(l int, c uint64, r float64, d float64, a model.
 	})
 }
 
+func (m *Metrics) MetricRisk(name string, v float64) {
+	m.preMetric(func() {
+		m.risk.WithLabelValues(name).Set(v)
+	})
+}
+
+func (m *Metrics) MetricPaper(name string, v float64) {
+	m.preMetric(func() {
+		m.paper.WithLabelValues(name).Set(v)
+	})
+}
+
+func (m *Metrics) MetricBribe(mode string, share, amount float64) {
+	m.preMetric(func() {
+		m.bribe.WithLabelValues(mode, "share").Set(share)
+		m.bribe.WithLabelValues(mode, "amount").Set(amount)
+	})
+}
+
+func (m *Metrics) MetricBribeOutcome(mode string, included bool, share, lowestIncluded float64) {
+	m.preMetric(func() {
+		m.bribes.WithLabelValues(mode, fmt.Sprintf("%t", included)).Inc()
+		m.bribe.WithLabelValues(mode, "share").Set(share)
+		m.bribe.WithLabelValues(mode, "lowest_included").Set(lowestIncluded)
+	})
+}
+
+func (m *Metrics) MetricRelay(relay, method string, accepted bool) {
+	m.preMetric(func() {
+		m.relays.WithLabelValues(relay, method, fmt.Sprintf("%t", accepted)).Inc()
+	})
+}
+
+func (m *Metrics) MetricPublic(outcome string) {
+	m.preMetric(func() {
+		m.public.WithLabelValues(outcome).Inc()
+	})
+}
+
+func (m *Metrics) MetricAccessList(l int, saved uint64, used bool) {
+	m.preMetric(func() {
+		m.accessLists.WithLabelValues(fmt.Sprint(l), fmt.Sprintf("%t", used)).Inc()
+		m.accessGas.WithLabelValues(fmt.Sprint(l)).Add(float64(saved))
+	})
+}
+
+// MetricPnL records a reconciled trade. values are in eth and keyed by
+// name, e.g. "realized" or "total_predicted_net".
+func (m *Metrics) MetricPnL(realized float64, values map[string]float64) {
+	m.preMetric(func() {
+		result := "profit"
+		if realized < 0 {
+			result = "loss"
+		}
+		m.pnlTrades.WithLabelValues(result).Inc()
+
+		for name, v := range values {
+			m.pnl.WithLabelValues(name).Set(v)
+		}
+	})
+}
+
+func (m *Metrics) MetricInventory(holder, token common.Address, v float64) {
+	m.preMetric(func() {
+		m.inventory.WithLabelValues(holder.Hex(), token.Hex()).Set(v)
+	})
+}
+
+func (m *Metrics) MetricInventoryAction(action string, success bool) {
+	m.preMetric(func() {
+		m.invActions.WithLabelValues(action, fmt.Sprintf("%t", success)).Inc()
+	})
+}
+
+// MetricCalibration observes a return error. tokens are the token labels of
+// the cycle, which the caller keeps to a bounded set.
+func (m *Metrics) MetricCalibration(stage string, l int, amms string, a model.AMT, tokens []string, err float64) {
+	m.preMetric(func() {
+		m.calib.WithLabelValues(stage, fmt.Sprint(l), amms, a.String()).Observe(err)
+		for _, t := range tokens {
+			m.calibToken.WithLabelValues(stage, t).Observe(err)
+		}
+	})
+}
+
+func (m *Metrics) MetricExact(a model.AMT, kept bool) {
+	m.preMetric(func() {
+		m.exact.WithLabelValues(a.String(), fmt.Sprintf("%t", kept)).Inc()
+	})
+}
+
+func (m *Metrics) MetricRevert(path string, slippage bool) {
+	m.preMetric(func() {
+		m.reverts.WithLabelValues(path, fmt.Sprintf("%t", slippage)).Inc()
+	})
+}
+
+func (m *Metrics) MetricJournalError() {
+	m.preMetric(func() {
+		m.journalErrs.Inc()
+	})
+}
+
 func (m *Metrics) preMetric(f func()) {
 	if On {
 		go f()
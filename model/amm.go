@@ -30,3 +30,17 @@ func AMMStoParams(aa []AMM) []*big.Int {
 	}
 	return res
 }
+
+func ParseAMM(s string) (AMM, bool) {
+	for _, a := range []AMM{AMMUniswapV2, AMMSushiswap} {
+		if a.String() == s {
+			return a, true
+		}
+	}
+
+	if i, err := strconv.Atoi(s); err == nil {
+		return AMM(i), true
+	}
+
+	return 0, false
+}
@@ -3,9 +3,11 @@ package model
 import (
 	"context"
 	"math"
+	"math/big"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/mitchellh/hashstructure/v2"
 )
 
@@ -42,6 +44,32 @@ type RunResult struct {
 	GasUsed     uint64
 	Return      float64
 	MaxGasPrice uint64
+	TargetBlock uint64
+
+	// AccessList is sent with the tx when it lowered the simulated gas.
+	AccessList types.AccessList
+
+	Sim *BundleSim
+
+	// Sent reports whether the run submitted anything, as opposed to one
+	// that stopped before, e.g. on a gate or with no keeper free.
+	Sent bool
+
+	// Txs are the live txs that were mined, in block order.
+	Txs []common.Hash
+}
+
+// BundleSim is the eth_callBundle result of a bundle before it was sent.
+// Amounts are in wei.
+type BundleSim struct {
+	StateBlock   uint64
+	GasUsed      uint64
+	CoinbaseDiff *big.Int
+	GasFees      *big.Int
+	Profit       *big.Int
+	NetProfit    *big.Int
+	Reverted     bool
+	Errors       []string
 }
 
 type cycleHash struct {
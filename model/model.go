@@ -15,4 +15,5 @@ var (
 
 	UniswapV1FactoryAddress = common.HexToAddress("0xc0a47dFe034B400B47bDaD5FecDa2621de6c4d95")
 	UniswapV2RouterAddress  = common.HexToAddress("0x7a250d5630B4cF539739dF2C5dAcb4c659F2488D")
+	SushiswapRouterAddress  = common.HexToAddress("0xd9e1cE17f2641f24aE83637ab66a2cca9C378B9F")
 )
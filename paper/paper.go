@@ -0,0 +1,224 @@
+package paper
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/util"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const tradesFile = "paper.jsonl"
+
+var (
+	// DefaultGas is the gas assumed for a cycle the checker did not measure.
+	DefaultGas uint64 = 400000
+
+	// WaitTimeout bounds the wait for the block a trade would have landed
+	// in, should the head stream stall.
+	WaitTimeout = time.Minute
+)
+
+type simulator interface {
+	Simulate(ctx context.Context, c *model.Cycle, block *big.Int) (float64, error)
+}
+
+type Trade struct {
+	Time     time.Time        `json:"time"`
+	Hash     uint64           `json:"hash"`
+	Amt      float64          `json:"amt"`
+	Tokens   []common.Address `json:"tokens"`
+	AMMs     []model.AMM      `json:"amms"`
+	Block    uint64           `json:"block"`
+	Expected float64          `json:"expected"`
+	Gas      uint64           `json:"gas"`
+	GasPrice *big.Int         `json:"gas_price"`
+	GasCost  float64          `json:"gas_cost"`
+	Resim    float64          `json:"resim"`
+	Existed  bool             `json:"existed"`
+	PnL      float64          `json:"pnl"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Exec is a scheduler executor that sends nothing. It prices each decision,
+// re-simulates it against the state of the block it would have landed in and
+// keeps a running hypothetical PnL.
+type Exec struct {
+	lock sync.Mutex
+	run  bool
+
+	c   *ethclient.Client
+	sim simulator
+
+	f   *os.File
+	enc *json.Encoder
+
+	pnl    float64
+	trades int
+	hits   int
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+func New(c *rpc.Client, m *metrics.Metrics) (*Exec, error) {
+	f, err := util.OpenAppend(tradesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exec{
+		c:       ethclient.NewClient(c),
+		f:       f,
+		enc:     json.NewEncoder(f),
+		metrics: m,
+		log:     m.WithField("context", "Paper"),
+	}, nil
+}
+
+func (e *Exec) SetSimulator(s simulator) {
+	e.sim = s
+}
+
+func (e *Exec) Running() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.run
+}
+
+func (e *Exec) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	e.lock.Lock()
+	if e.run {
+		e.lock.Unlock()
+		return nil, errors.New("running")
+	}
+	e.run = true
+	e.lock.Unlock()
+
+	defer func() {
+		e.lock.Lock()
+		e.run = false
+		e.lock.Unlock()
+	}()
+
+	if e.sim == nil {
+		return nil, errors.New("paper: no simulator")
+	}
+
+	t := &Trade{
+		Time:   time.Now(),
+		Hash:   c.Hash(),
+		Amt:    c.Amt.Float(),
+		Tokens: c.ParamAddrs,
+		AMMs:   c.ParamAMMs,
+		Gas:    DefaultGas,
+	}
+
+	if c.TestRes != nil {
+		t.Expected = c.TestRes.Return
+		if c.TestRes.GasUsed > 0 {
+			t.Gas = c.TestRes.GasUsed
+		}
+	}
+
+	head, err := e.c.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "paper: head")
+	}
+	t.Block = head.Number.Uint64() + 1
+
+	t.GasPrice, err = e.c.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "paper: gas price")
+	}
+	t.GasCost = weiToEth(new(big.Int).Mul(t.GasPrice, new(big.Int).SetUint64(t.Gas)))
+
+	// the decision is made: a live tx would be out whatever happens to the
+	// cycle now, so the wait does not follow ctx
+	if err := e.waitForBlock(t.Block); err != nil {
+		t.Error = "wait: " + err.Error()
+	} else {
+		simCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		t.Resim, err = e.sim.Simulate(simCtx, c, new(big.Int).SetUint64(t.Block))
+		if err != nil {
+			t.Error = err.Error()
+		}
+	}
+
+	t.Existed = t.Error == "" && t.Resim > t.GasCost
+	if t.Existed {
+		t.PnL = t.Resim - t.GasCost
+	}
+
+	e.record(t)
+
+	return &model.RunResult{
+		Success:     t.Existed,
+		Return:      t.Resim,
+		GasUsed:     t.Gas,
+		TargetBlock: t.Block,
+	}, nil
+}
+
+func (e *Exec) record(t *Trade) {
+	e.lock.Lock()
+	e.trades++
+	if t.Existed {
+		e.hits++
+	}
+	e.pnl += t.PnL
+	pnl, trades, hits := e.pnl, e.trades, e.hits
+	_ = e.enc.Encode(t)
+	e.lock.Unlock()
+
+	e.log.Printf("PAPER TX: hash = %d block = %d expected = %.5f resim = %.5f gas = %.5f existed = %t pnl = %.5f total = %.5f (%d/%d)",
+		t.Hash, t.Block, t.Expected, t.Resim, t.GasCost, t.Existed, t.PnL, pnl, hits, trades)
+
+	e.metrics.MetricPaper("pnl", pnl)
+	e.metrics.MetricPaper("trades", float64(trades))
+	e.metrics.MetricPaper("hits", float64(hits))
+}
+
+func (e *Exec) waitForBlock(n uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+
+	ch := make(chan *types.Header)
+	subs, err := e.c.SubscribeNewHead(ctx, ch)
+	if err != nil {
+		return err
+	}
+
+	defer subs.Unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-subs.Err():
+			return err
+		case h := <-ch:
+			if h.Number.Uint64() >= n {
+				return nil
+			}
+		}
+	}
+}
+
+func weiToEth(w *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(w), big.NewFloat(1e+18)).Float64()
+	return f
+}
@@ -0,0 +1,323 @@
+// Package pnl works out what live trades actually earned from their
+// receipts.
+package pnl
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/0xnibbler/mev-q4-2020/journal"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	transferSig   = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	depositSig    = crypto.Keccak256Hash([]byte("Deposit(address,uint256)"))
+	withdrawalSig = crypto.Keccak256Hash([]byte("Withdrawal(address,uint256)"))
+)
+
+// Trade is the realized outcome of one live run. Amounts are in wei or
+// token units.
+type Trade struct {
+	Block uint64
+	Txs   []common.Hash
+
+	// Deltas are the net token transfers into the watched addresses. WETH
+	// wrapped or unwrapped by them is not counted, it stays theirs.
+	Deltas map[common.Address]*big.Int
+
+	// GasCost is what the senders paid for gas, priority fee included.
+	GasCost *big.Int
+
+	// Coinbase is the ether the executor sent on, which it only does to
+	// pay the block's miner.
+	Coinbase *big.Int
+
+	// Profit is the WETH delta less gas and coinbase payment.
+	Profit *big.Int
+
+	// Predicted and Simulated are the expected profits in eth, from the
+	// cycle's return and its last check. Both are gross, like Gross, the
+	// WETH delta; Realized is net, like Profit. PredictedNet and
+	// SimulatedNet take what the trade paid for gas and the coinbase off
+	// the expectations, so they compare with Realized.
+	Predicted    float64
+	Simulated    float64
+	PredictedNet float64
+	SimulatedNet float64
+	Gross        float64
+	Realized     float64
+}
+
+// Residual lists the tokens other than WETH the trade left a balance change
+// in, which a closed cycle should not.
+func (t *Trade) Residual() []common.Address {
+	var aa []common.Address
+	for a, d := range t.Deltas {
+		if a != model.WETHAddress && d.Sign() != 0 {
+			aa = append(aa, a)
+		}
+	}
+	return aa
+}
+
+type realizer interface {
+	Realized(profit, spend float64)
+}
+
+type calibrator interface {
+	Realized(c *model.Cycle, gross float64)
+}
+
+// Reconciler reads the receipts of mined live txs. Besides the tx senders
+// it watches the executor contract, if there is one.
+type Reconciler struct {
+	c *ethclient.Client
+
+	executor common.Address
+	journal  *journal.Journal
+	realizer realizer
+	calib    calibrator
+
+	lock                    sync.Mutex
+	realized, gross         float64
+	predicted, predictedNet float64
+	trades, losses          int
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+func New(c *rpc.Client, executor common.Address, j *journal.Journal, m *metrics.Metrics) *Reconciler {
+	return &Reconciler{
+		c:        ethclient.NewClient(c),
+		executor: executor,
+		journal:  j,
+		metrics:  m,
+		log:      m.WithField("context", "PnL"),
+	}
+}
+
+// SetRealizer makes every reconciled trade count towards g's daily loss.
+func (r *Reconciler) SetRealizer(g realizer) {
+	r.realizer = g
+}
+
+// SetCalibrator has every reconciled trade compared with what was predicted
+// and simulated for it.
+func (r *Reconciler) SetCalibrator(cl calibrator) {
+	r.calib = cl
+}
+
+// Reconcile works out the trade behind res and records it in the journal,
+// the realizer and the metrics.
+func (r *Reconciler) Reconcile(ctx context.Context, c *model.Cycle, res *model.RunResult) error {
+	if res == nil || len(res.Txs) == 0 {
+		return nil
+	}
+
+	t, err := r.trade(ctx, res.Txs)
+	if err != nil {
+		return err
+	}
+
+	costs := weiToEth(t.GasCost) + weiToEth(t.Coinbase)
+
+	t.Predicted = (c.Return - 1) * c.Amt.Float()
+	if c.TestRes != nil {
+		t.Simulated = c.TestRes.Return
+	}
+	t.PredictedNet = t.Predicted - costs
+	t.SimulatedNet = t.Simulated - costs
+	t.Gross = weiToEth(delta(t.Deltas, model.WETHAddress))
+	t.Realized = weiToEth(t.Profit)
+
+	r.lock.Lock()
+	r.trades++
+	if t.Realized < 0 {
+		r.losses++
+	}
+	r.realized += t.Realized
+	r.gross += t.Gross
+	r.predicted += t.Predicted
+	r.predictedNet += t.PredictedNet
+	values := map[string]float64{
+		"total_realized":       r.realized,
+		"total_realized_gross": r.gross,
+		"total_predicted":      r.predicted,
+		"total_predicted_net":  r.predictedNet,
+	}
+	r.lock.Unlock()
+
+	r.journal.Profit(c, t.Block, t.Realized)
+	if r.realizer != nil {
+		r.realizer.Realized(t.Realized, costs)
+	}
+	if r.calib != nil {
+		r.calib.Realized(c, t.Gross)
+	}
+
+	values["realized"] = t.Realized
+	values["realized_gross"] = t.Gross
+	values["predicted"] = t.Predicted
+	values["predicted_net"] = t.PredictedNet
+	values["simulated"] = t.Simulated
+	values["simulated_net"] = t.SimulatedNet
+	values["gas"] = weiToEth(t.GasCost)
+	values["coinbase"] = weiToEth(t.Coinbase)
+	r.metrics.MetricPnL(t.Realized, values)
+
+	log := r.log.WithField("hash", c.Hash()).WithField("block", t.Block)
+	log.Printf("gross realized %.6f predicted %.6f simulated %.6f, net realized %.6f predicted %.6f simulated %.6f, gas %.6f coinbase %.6f",
+		t.Gross, t.Predicted, t.Simulated, t.Realized, t.PredictedNet, t.SimulatedNet, weiToEth(t.GasCost), weiToEth(t.Coinbase))
+	if rr := t.Residual(); len(rr) > 0 {
+		log.Warnf("tokens left behind: %v", rr)
+	}
+
+	return nil
+}
+
+// Totals returns the cumulative realized and predicted profit in eth, both
+// net of gas and coinbase payments, and the number of trades and losing
+// trades.
+func (r *Reconciler) Totals() (realized, predicted float64, trades, losses int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.realized, r.predictedNet, r.trades, r.losses
+}
+
+func (r *Reconciler) trade(ctx context.Context, hashes []common.Hash) (*Trade, error) {
+	t := &Trade{
+		Txs:      hashes,
+		Deltas:   make(map[common.Address]*big.Int),
+		GasCost:  new(big.Int),
+		Coinbase: new(big.Int),
+	}
+
+	watch := make(map[common.Address]bool)
+	if r.executor != (common.Address{}) {
+		watch[r.executor] = true
+	}
+
+	var logs []*types.Log
+	var header *types.Header
+
+	for _, h := range hashes {
+		rc, err := r.c.TransactionReceipt(ctx, h)
+		if err != nil {
+			return nil, errors.Wrap(err, "receipt "+h.Hex())
+		}
+
+		if header == nil {
+			if header, err = r.c.HeaderByHash(ctx, rc.BlockHash); err != nil {
+				return nil, errors.Wrap(err, "header")
+			}
+			t.Block = header.Number.Uint64()
+		}
+
+		tx, _, err := r.c.TransactionByHash(ctx, h)
+		if err != nil {
+			return nil, errors.Wrap(err, "tx "+h.Hex())
+		}
+
+		from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+		if err != nil {
+			return nil, err
+		}
+		watch[from] = true
+
+		t.GasCost.Add(t.GasCost, new(big.Int).Mul(new(big.Int).SetUint64(rc.GasUsed), effectivePrice(tx, header.BaseFee)))
+
+		logs = append(logs, rc.Logs...)
+	}
+
+	// ether the executor got from unwrapping, less what it wrapped
+	unwrapped := new(big.Int)
+
+	for _, l := range logs {
+		switch {
+		case len(l.Topics) == 3 && l.Topics[0] == transferSig && len(l.Data) == 32:
+			from, to := common.BytesToAddress(l.Topics[1][:]), common.BytesToAddress(l.Topics[2][:])
+			amt := new(big.Int).SetBytes(l.Data)
+
+			if watch[from] {
+				delta(t.Deltas, l.Address).Sub(delta(t.Deltas, l.Address), amt)
+			}
+			if watch[to] {
+				delta(t.Deltas, l.Address).Add(delta(t.Deltas, l.Address), amt)
+			}
+
+		case len(l.Topics) == 2 && l.Address == model.WETHAddress && len(l.Data) == 32:
+			who := common.BytesToAddress(l.Topics[1][:])
+			if who != r.executor {
+				continue
+			}
+
+			amt := new(big.Int).SetBytes(l.Data)
+			switch l.Topics[0] {
+			case withdrawalSig:
+				unwrapped.Add(unwrapped, amt)
+			case depositSig:
+				unwrapped.Sub(unwrapped, amt)
+			}
+		}
+	}
+
+	// the executor holds no ether between trades, so whatever it unwrapped
+	// and does not hold after the block went to the miner
+	if r.executor != (common.Address{}) {
+		before, err := r.c.BalanceAt(ctx, r.executor, new(big.Int).Sub(header.Number, big.NewInt(1)))
+		if err != nil {
+			return nil, errors.Wrap(err, "executor balance")
+		}
+		after, err := r.c.BalanceAt(ctx, r.executor, header.Number)
+		if err != nil {
+			return nil, errors.Wrap(err, "executor balance")
+		}
+
+		t.Coinbase.Sub(unwrapped, new(big.Int).Sub(after, before))
+		if t.Coinbase.Sign() < 0 {
+			t.Coinbase.SetUint64(0)
+		}
+	}
+
+	t.Profit = new(big.Int).Set(delta(t.Deltas, model.WETHAddress))
+	t.Profit.Sub(t.Profit, t.GasCost)
+	t.Profit.Sub(t.Profit, t.Coinbase)
+
+	return t, nil
+}
+
+func delta(m map[common.Address]*big.Int, a common.Address) *big.Int {
+	if m[a] == nil {
+		m[a] = new(big.Int)
+	}
+	return m[a]
+}
+
+// effectivePrice is the gas price tx paid in a block with baseFee.
+func effectivePrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasPrice()
+	}
+	tip, err := tx.EffectiveGasTip(baseFee)
+	if err != nil {
+		return tx.GasPrice()
+	}
+	return tip.Add(tip, baseFee)
+}
+
+func weiToEth(w *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(w), big.NewFloat(1e18)).Float64()
+	return f
+}
@@ -0,0 +1,216 @@
+package pnl
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/sirupsen/logrus"
+)
+
+// node answers the calls trade makes from canned blocks.
+type node struct {
+	header   *types.Header
+	txs      map[common.Hash]*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+
+	// balances of the executor by block
+	balances map[uint64]*big.Int
+}
+
+func (n *node) GetTransactionReceipt(h common.Hash) (*types.Receipt, error) {
+	if r, ok := n.receipts[h]; ok {
+		return r, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (n *node) GetBlockByHash(h common.Hash, full bool) (*types.Header, error) {
+	return n.header, nil
+}
+
+func (n *node) GetTransactionByHash(h common.Hash) (map[string]interface{}, error) {
+	b, err := n.txs[h].MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	m["blockHash"] = n.header.Hash()
+	m["blockNumber"] = hexutil.EncodeBig(n.header.Number)
+	return m, nil
+}
+
+func (n *node) GetBalance(a common.Address, block string) (*hexutil.Big, error) {
+	b, err := hexutil.DecodeUint64(block)
+	if err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(n.balances[b]), nil
+}
+
+type realized struct {
+	profit, spend float64
+}
+
+func (r *realized) Realized(profit, spend float64) {
+	r.profit, r.spend = profit, spend
+}
+
+func eth(f float64) *big.Int {
+	w, _ := new(big.Float).Mul(big.NewFloat(f), big.NewFloat(1e18)).Int(nil)
+	return w
+}
+
+func word(b *big.Int) []byte {
+	return common.LeftPadBytes(b.Bytes(), 32)
+}
+
+func transfer(token, from, to common.Address, amt *big.Int) *types.Log {
+	return &types.Log{Address: token, Topics: []common.Hash{transferSig, from.Hash(), to.Hash()}, Data: word(amt)}
+}
+
+func withdrawal(who common.Address, amt *big.Int) *types.Log {
+	return &types.Log{Address: model.WETHAddress, Topics: []common.Hash{withdrawalSig, who.Hash()}, Data: word(amt)}
+}
+
+func TestTrade(t *testing.T) {
+	metrics.On = false
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	m := &metrics.Metrics{FieldLogger: log}
+
+	key, _ := crypto.GenerateKey()
+	executor := common.HexToAddress("0xe")
+	pairA, pairB := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+	tokenA := common.HexToAddress("0xa")
+	stranger := common.HexToAddress("0x5")
+
+	baseFee := big.NewInt(10 * params.GWei)
+	header := &types.Header{Number: big.NewInt(100), BaseFee: baseFee, Difficulty: new(big.Int)}
+
+	tx, err := types.SignTx(types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		GasTipCap: big.NewInt(2 * params.GWei),
+		GasFeeCap: big.NewInt(100 * params.GWei),
+		Gas:       300000,
+		To:        &executor,
+		Value:     new(big.Int),
+	}), types.LatestSignerForChainID(big.NewInt(1)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 200000 gas at base fee plus tip
+	gasCost := new(big.Int).Mul(big.NewInt(200000), big.NewInt(12*params.GWei))
+
+	cycle := []*types.Log{
+		transfer(model.WETHAddress, executor, pairA, eth(1)),
+		transfer(tokenA, pairA, pairB, eth(50)),
+		transfer(model.WETHAddress, pairB, executor, eth(1.05)),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		logs     []*types.Log
+		status   uint64
+		before   float64
+		after    float64
+		coinbase *big.Int
+		gross    *big.Int
+		residual int
+	}{
+		{"coinbase paid", append(cycle, withdrawal(executor, eth(0.02))), types.ReceiptStatusSuccessful, 0, 0, eth(0.02), eth(0.05), 0},
+		{"unwrapped and kept", append(cycle, withdrawal(executor, eth(0.02))), types.ReceiptStatusSuccessful, 0, 0.02, new(big.Int), eth(0.05), 0},
+		{"no bribe", cycle, types.ReceiptStatusSuccessful, 1, 1, new(big.Int), eth(0.05), 0},
+		{"others' unwraps", append(cycle, withdrawal(stranger, eth(0.02))), types.ReceiptStatusSuccessful, 0, 0, new(big.Int), eth(0.05), 0},
+		{"tokens left", append(cycle, transfer(tokenA, pairB, executor, eth(1))), types.ReceiptStatusSuccessful, 0, 0, new(big.Int), eth(0.05), 1},
+		{"reverted", []*types.Log{}, types.ReceiptStatusFailed, 0, 0, new(big.Int), new(big.Int), 0},
+	} {
+		n := &node{
+			header:   header,
+			txs:      map[common.Hash]*types.Transaction{tx.Hash(): tx},
+			balances: map[uint64]*big.Int{99: eth(tc.before), 100: eth(tc.after)},
+		}
+		rc := &types.Receipt{
+			Type:              types.DynamicFeeTxType,
+			Status:            tc.status,
+			CumulativeGasUsed: 200000,
+			GasUsed:           200000,
+			TxHash:            tx.Hash(),
+			BlockHash:         header.Hash(),
+			BlockNumber:       header.Number,
+			Logs:              tc.logs,
+		}
+		for _, l := range rc.Logs {
+			l.TxHash, l.BlockHash, l.BlockNumber = tx.Hash(), header.Hash(), header.Number.Uint64()
+		}
+		n.receipts = map[common.Hash]*types.Receipt{tx.Hash(): rc}
+
+		srv := rpc.NewServer()
+		if err := srv.RegisterName("eth", n); err != nil {
+			t.Fatal(err)
+		}
+		hs := httptest.NewServer(srv)
+		c, err := rpc.DialHTTP(hs.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := New(c, executor, nil, m)
+		rz := &realized{}
+		r.SetRealizer(rz)
+
+		tr, err := r.trade(context.Background(), []common.Hash{tx.Hash()})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		profit := new(big.Int).Sub(tc.gross, gasCost)
+		profit.Sub(profit, tc.coinbase)
+
+		switch {
+		case tr.Block != 100:
+			t.Errorf("%s: block %d", tc.name, tr.Block)
+		case tr.GasCost.Cmp(gasCost) != 0:
+			t.Errorf("%s: gas cost %s, want %s", tc.name, tr.GasCost, gasCost)
+		case tr.Coinbase.Cmp(tc.coinbase) != 0:
+			t.Errorf("%s: coinbase %s, want %s", tc.name, tr.Coinbase, tc.coinbase)
+		case delta(tr.Deltas, model.WETHAddress).Cmp(tc.gross) != 0:
+			t.Errorf("%s: WETH delta %s, want %s", tc.name, tr.Deltas[model.WETHAddress], tc.gross)
+		case tr.Profit.Cmp(profit) != 0:
+			t.Errorf("%s: profit %s, want %s", tc.name, tr.Profit, profit)
+		case len(tr.Residual()) != tc.residual:
+			t.Errorf("%s: residual %v", tc.name, tr.Residual())
+		}
+
+		cy := model.NewCycle([]model.Half{{To: 0}, {To: 1}}, 1.06, model.AMT1, 0)
+		cy.SetParams([]common.Address{model.WETHAddress, tokenA}, []model.AMM{model.AMMSushiswap, model.AMMUniswapV2})
+		if err := r.Reconcile(context.Background(), cy, &model.RunResult{Txs: []common.Hash{tx.Hash()}}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if want := weiToEth(profit); rz.profit != want {
+			t.Errorf("%s: realized %f, want %f", tc.name, rz.profit, want)
+		}
+		if want := weiToEth(gasCost) + weiToEth(tc.coinbase); rz.spend != want {
+			t.Errorf("%s: spend %f, want %f", tc.name, rz.spend, want)
+		}
+
+		c.Close()
+		hs.Close()
+	}
+}
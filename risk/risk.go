@@ -0,0 +1,332 @@
+package risk
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/telegram"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTripped = errors.New("risk: circuit breaker tripped")
+	ErrLimit   = errors.New("risk: limit reached")
+)
+
+type Limits struct {
+	MaxNotional      float64 // eth per trade
+	MaxTradesPerHour int
+	MaxGasPerDay     uint64
+	// MaxSpendPerDay caps gas at its effective price plus coinbase
+	// payments, in eth.
+	MaxSpendPerDay         float64
+	MaxLossPerDay          float64 // eth
+	MaxConsecutiveFailures int
+}
+
+var DefaultLimits = Limits{
+	MaxNotional:            model.MaxLiveAMT.Float(),
+	MaxTradesPerHour:       60,
+	MaxGasPerDay:           50000000,
+	MaxSpendPerDay:         1,
+	MaxLossPerDay:          0.5,
+	MaxConsecutiveFailures: 20,
+}
+
+// ResetToken is what a POST to the guard has to carry in its X-Risk-Token
+// header to reset the breaker. Without one only local requests may reset it.
+var ResetToken string
+
+var alert = func(msg string) error {
+	return telegram.Message(time.Now(), msg, true)
+}
+
+type exec interface {
+	Running() bool
+	Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error)
+}
+
+// Guard sits between the scheduler and the live executor, enforcing Limits
+// and tripping a circuit breaker that stays open until Reset is called.
+type Guard struct {
+	lock sync.Mutex
+	x    exec
+
+	limits Limits
+
+	trades   []time.Time
+	day      time.Time
+	gas      uint64
+	spend    float64
+	pnl      float64
+	failures int
+
+	tripped bool
+	reason  string
+
+	OnTrip  func(reason string)
+	OnReset func()
+
+	metrics *metrics.Metrics
+	log     logrus.FieldLogger
+}
+
+func New(x exec, l Limits, m *metrics.Metrics) *Guard {
+	return &Guard{
+		x:       x,
+		limits:  l,
+		day:     today(),
+		metrics: m,
+		log:     m.WithField("context", "Risk"),
+	}
+}
+
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+func (g *Guard) Running() bool {
+	g.lock.Lock()
+	blocked := g.tripped || g.limitErr() != nil
+	g.lock.Unlock()
+
+	return blocked || g.x.Running()
+}
+
+func (g *Guard) Allow(c *model.Cycle) bool {
+	return c.Amt.Float() <= g.limits.MaxNotional
+}
+
+func (g *Guard) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	g.lock.Lock()
+	if g.tripped {
+		g.lock.Unlock()
+		return nil, ErrTripped
+	}
+	if err := g.limitErr(); err != nil {
+		g.lock.Unlock()
+		return nil, err
+	}
+	if !g.Allow(c) {
+		g.lock.Unlock()
+		return nil, errors.Wrap(ErrLimit, fmt.Sprintf("notional %.2f > %.2f", c.Amt.Float(), g.limits.MaxNotional))
+	}
+	g.trades = append(g.trades, time.Now())
+	g.lock.Unlock()
+
+	res, err := g.x.Run(ctx, c)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.rollDay()
+
+	// runs that stopped before submitting, on a gate, a cost check or for
+	// want of a keeper, spend nothing and say nothing about inclusion
+	switch {
+	case res == nil || !res.Sent:
+	case res.Success:
+		g.failures = 0
+	default:
+		g.failures++
+	}
+
+	// mined txs burn gas whether they reverted or not, what it cost comes
+	// with Realized once the receipts are read
+	if res != nil && len(res.Txs) > 0 {
+		g.gas += res.GasUsed
+	}
+
+	g.report()
+
+	if g.limits.MaxConsecutiveFailures > 0 && g.failures >= g.limits.MaxConsecutiveFailures {
+		g.trip(fmt.Sprintf("%d consecutive failed inclusions", g.failures))
+	} else if err := g.limitErr(); err != nil {
+		g.log.WithError(err).Warnln("risk limit reached")
+	}
+
+	return res, err
+}
+
+// Updated passes return changes of in-flight cycles on to the executor.
+func (g *Guard) Updated(c *model.Cycle, r float64) {
+	if u, ok := g.x.(interface{ Updated(*model.Cycle, float64) }); ok {
+		u.Updated(c, r)
+	}
+}
+
+// Realized records the realized profit (negative for a loss) of a mined
+// trade and what it spent on gas and coinbase payments, tripping the breaker
+// once the daily loss limit is exceeded.
+func (g *Guard) Realized(profit, spend float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.rollDay()
+	g.pnl += profit
+	g.spend += spend
+	g.report()
+
+	if g.limits.MaxLossPerDay > 0 && -g.pnl >= g.limits.MaxLossPerDay {
+		g.trip(fmt.Sprintf("daily loss %.5f eth", -g.pnl))
+	} else if err := g.limitErr(); err != nil {
+		g.log.WithError(err).Warnln("risk limit reached")
+	}
+}
+
+func (g *Guard) Tripped() (bool, string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.tripped, g.reason
+}
+
+func (g *Guard) Reset() {
+	g.lock.Lock()
+	if !g.tripped {
+		g.lock.Unlock()
+		return
+	}
+	g.tripped = false
+	g.reason = ""
+	g.failures = 0
+	g.report()
+	g.lock.Unlock()
+
+	g.log.Warnln("circuit breaker reset")
+
+	if g.OnReset != nil {
+		g.OnReset()
+	}
+}
+
+func (g *Guard) trip(reason string) {
+	if g.tripped {
+		return
+	}
+
+	g.tripped = true
+	g.reason = reason
+	g.report()
+
+	g.log.Errorln("CIRCUIT BREAKER TRIPPED:", reason)
+
+	go func() {
+		if err := alert("<b>circuit breaker tripped</b>\n" + reason); err != nil {
+			g.log.WithError(err).Error("telegram alert")
+		}
+	}()
+
+	if g.OnTrip != nil {
+		g.OnTrip(reason)
+	}
+}
+
+func (g *Guard) limitErr() error {
+	g.rollDay()
+
+	l := g.limits
+	switch {
+	case l.MaxTradesPerHour > 0 && len(g.trades) >= l.MaxTradesPerHour:
+		return errors.Wrap(ErrLimit, "trades per hour")
+	case l.MaxGasPerDay > 0 && g.gas >= l.MaxGasPerDay:
+		return errors.Wrap(ErrLimit, "gas per day")
+	case l.MaxSpendPerDay > 0 && g.spend >= l.MaxSpendPerDay:
+		return errors.Wrap(ErrLimit, "spend per day")
+	case l.MaxLossPerDay > 0 && -g.pnl >= l.MaxLossPerDay:
+		return errors.Wrap(ErrLimit, "loss per day")
+	}
+
+	return nil
+}
+
+func (g *Guard) rollDay() {
+	hourAgo := time.Now().Add(-time.Hour)
+	i := 0
+	for i < len(g.trades) && g.trades[i].Before(hourAgo) {
+		i++
+	}
+	g.trades = g.trades[i:]
+
+	if d := today(); d.After(g.day) {
+		g.day = d
+		g.gas, g.spend, g.pnl = 0, 0, 0
+	}
+}
+
+func (g *Guard) report() {
+	tripped := 0.
+	if g.tripped {
+		tripped = 1
+	}
+
+	g.metrics.MetricRisk("tripped", tripped)
+	g.metrics.MetricRisk("trades_hour", float64(len(g.trades)))
+	g.metrics.MetricRisk("gas_day", float64(g.gas))
+	g.metrics.MetricRisk("spend_day", g.spend)
+	g.metrics.MetricRisk("pnl_day", g.pnl)
+	g.metrics.MetricRisk("failures", float64(g.failures))
+}
+
+type status struct {
+	Tripped  bool    `json:"tripped"`
+	Reason   string  `json:"reason,omitempty"`
+	Trades   int     `json:"trades_hour"`
+	Gas      uint64  `json:"gas_day"`
+	Spend    float64 `json:"spend_day"`
+	PnL      float64 `json:"pnl_day"`
+	Failures int     `json:"failures"`
+	Limits   Limits  `json:"limits"`
+}
+
+// ServeHTTP reports the guard state; an authorized POST resets a tripped
+// breaker.
+func (g *Guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !canReset(r) {
+			http.Error(w, "risk: reset not allowed", http.StatusForbidden)
+			return
+		}
+		g.Reset()
+	}
+
+	g.lock.Lock()
+	g.rollDay()
+	st := status{
+		Tripped:  g.tripped,
+		Reason:   g.reason,
+		Trades:   len(g.trades),
+		Gas:      g.gas,
+		Spend:    g.spend,
+		PnL:      g.pnl,
+		Failures: g.failures,
+		Limits:   g.limits,
+	}
+	g.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// canReset takes ResetToken if there is one, or else a loopback client.
+func canReset(r *http.Request) bool {
+	if ResetToken != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Risk-Token")), []byte(ResetToken)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
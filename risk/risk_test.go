@@ -0,0 +1,179 @@
+package risk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeExec struct {
+	res *model.RunResult
+}
+
+func (f *fakeExec) Running() bool { return false }
+
+func (f *fakeExec) Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error) {
+	return f.res, f.res.Error
+}
+
+func testGuard(t *testing.T, l Limits) (*Guard, *fakeExec, *[]string) {
+	t.Helper()
+
+	metrics.On = false
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	alert = func(string) error { return nil }
+
+	x := &fakeExec{}
+	g := New(x, l, &metrics.Metrics{FieldLogger: log})
+
+	var events []string
+	g.OnTrip = func(reason string) { events = append(events, "trip") }
+	g.OnReset = func() { events = append(events, "reset") }
+
+	return g, x, &events
+}
+
+func testCycle() *model.Cycle {
+	c := model.NewCycle([]model.Half{{To: 0}, {To: 1}}, 1.01, model.AMT1, 0)
+	c.SetParams([]common.Address{model.WETHAddress, common.HexToAddress("0xa")}, []model.AMM{model.AMMSushiswap, model.AMMUniswapV2})
+	return c
+}
+
+var (
+	missed   = &model.RunResult{Sent: true, Error: errors.New("not included")}
+	included = &model.RunResult{Sent: true, Success: true, GasUsed: 100000, Txs: []common.Hash{{1}}}
+	reverted = &model.RunResult{Sent: true, Error: errors.New("reverted"), GasUsed: 50000, Txs: []common.Hash{{2}}}
+	unsent   = &model.RunResult{Error: errors.New("no idle keeper")}
+)
+
+func TestFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		runs    []*model.RunResult
+		tripped bool
+	}{
+		{"three missed", []*model.RunResult{missed, missed, missed}, true},
+		{"mined revert", []*model.RunResult{missed, reverted, missed}, true},
+		{"reset by inclusion", []*model.RunResult{missed, missed, included, missed}, false},
+		{"unsent runs", []*model.RunResult{missed, unsent, unsent, missed}, false},
+	} {
+		g, x, events := testGuard(t, Limits{MaxNotional: 10, MaxConsecutiveFailures: 3})
+
+		for _, res := range tc.runs {
+			x.res = res
+			_, _ = g.Run(context.Background(), testCycle())
+		}
+
+		if tripped, _ := g.Tripped(); tripped != tc.tripped {
+			t.Errorf("%s: tripped %t", tc.name, tripped)
+		}
+		if tc.tripped != (len(*events) == 1) {
+			t.Errorf("%s: events %v", tc.name, *events)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	g, x, _ := testGuard(t, Limits{MaxNotional: 1, MaxTradesPerHour: 10, MaxGasPerDay: 120000, MaxSpendPerDay: 0.1, MaxLossPerDay: 0.5})
+
+	big := model.NewCycle([]model.Half{{To: 0}, {To: 1}}, 1.01, model.AMT10, 0)
+	if _, err := g.Run(context.Background(), big); errors.Cause(err) != ErrLimit {
+		t.Errorf("notional: %v", err)
+	}
+
+	x.res = included
+	if _, err := g.Run(context.Background(), testCycle()); err != nil {
+		t.Fatal(err)
+	}
+	x.res = reverted
+	_, _ = g.Run(context.Background(), testCycle())
+
+	// both mined, 150000 gas
+	if _, err := g.Run(context.Background(), testCycle()); errors.Cause(err) != ErrLimit {
+		t.Errorf("gas per day: %v", err)
+	}
+	if !g.Running() {
+		t.Error("running below a limit")
+	}
+
+	g.gas = 0
+	g.Realized(0.01, 0.1)
+	if _, err := g.Run(context.Background(), testCycle()); errors.Cause(err) != ErrLimit {
+		t.Errorf("spend per day: %v", err)
+	}
+	if tripped, _ := g.Tripped(); tripped {
+		t.Error("spend limit tripped the breaker")
+	}
+
+	g.spend = 0
+	g.Realized(-0.6, 0.01)
+	if tripped, reason := g.Tripped(); !tripped {
+		t.Error("daily loss did not trip")
+	} else if reason == "" {
+		t.Error("no reason")
+	}
+	if _, err := g.Run(context.Background(), testCycle()); err != ErrTripped {
+		t.Errorf("tripped: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	defer func() { ResetToken = "" }()
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		header string
+		remote string
+		reset  bool
+	}{
+		{"local", "", "", "127.0.0.1:5000", true},
+		{"local v6", "", "", "[::1]:5000", true},
+		{"remote", "", "", "10.0.0.2:5000", false},
+		{"token", "secret", "secret", "10.0.0.2:5000", true},
+		{"bad token", "secret", "guess", "10.0.0.2:5000", false},
+		{"token needed locally", "secret", "", "127.0.0.1:5000", false},
+	} {
+		ResetToken = tc.token
+
+		g, x, events := testGuard(t, Limits{MaxNotional: 10, MaxConsecutiveFailures: 1})
+		x.res = missed
+		_, _ = g.Run(context.Background(), testCycle())
+
+		r := httptest.NewRequest(http.MethodPost, "/risk", nil)
+		r.RemoteAddr = tc.remote
+		if tc.header != "" {
+			r.Header.Set("X-Risk-Token", tc.header)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+
+		tripped, _ := g.Tripped()
+		if tripped == tc.reset {
+			t.Errorf("%s: tripped %t after reset", tc.name, tripped)
+		}
+		if !tc.reset && w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d", tc.name, w.Code)
+		}
+		if tc.reset && (len(*events) != 2 || (*events)[1] != "reset") {
+			t.Errorf("%s: events %v", tc.name, *events)
+		}
+	}
+
+	g, _, _ := testGuard(t, DefaultLimits)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/risk", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+}
@@ -3,22 +3,29 @@ package scheduler
 import (
 	"context"
 	"fmt"
+	"html"
+	"math/big"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/journal"
 	"github.com/0xnibbler/mev-q4-2020/metrics"
 	"github.com/0xnibbler/mev-q4-2020/model"
+	"github.com/0xnibbler/mev-q4-2020/telegram"
 
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 const MIN_TX_WAIT_TIME = time.Second * 1
 
 var (
+	// Live is whether a new scheduler runs cycles, see SetLive.
 	Live       = true
 	lastLiveTx time.Time
 )
@@ -27,14 +34,24 @@ type Scheduler struct {
 	cycles map[uint64]*model.Cycle
 
 	client  *rpc.Client
-	checker *checker
+	checker Checker
+	filters []filter
+	gates   []filter
+	recon   Reconciler
+	calib   Calibrator
+	explain Explainer
 
 	newCycleCh chan []*model.Cycle
 	remCycleCh chan map[uint64]struct{}
 	updCycleCh chan map[uint64]float64
 	resCycleCh chan map[uint64]*model.RunResult
 
-	xLive exec
+	xLive      exec
+	liveOn     int32
+	live       map[uint64]*model.Cycle
+	liveDoneCh chan uint64
+
+	journal *journal.Journal
 
 	log     logrus.FieldLogger
 	metrics *metrics.Metrics
@@ -45,20 +62,45 @@ type exec interface {
 	Run(ctx context.Context, c *model.Cycle) (*model.RunResult, error)
 }
 
-func New(client *rpc.Client /*, xt texec*/, xl exec, m *metrics.Metrics /*, gas *gas.Tracker*/) *Scheduler {
-	ch, err := newChecker(client,
-		common.HexToAddress("0xf94e0580684b30c18249b270262232a5fd145611"),
-		common.HexToAddress("0xb8a68725d217e5cd7f7a13df51c2116ef3576917"),
-	)
+// Checker simulates a cycle against the pending state, or the state at
+// block if it is not nil.
+type Checker interface {
+	Check(ctx context.Context, c *model.Cycle, block *big.Int) (*model.RunResult, error)
+}
 
-	if err != nil {
-		panic(err)
-	}
+// filter is implemented by executors that refuse some cycles up front
+// (e.g. the risk guard), so they are not picked as the live candidate.
+type filter interface {
+	Allow(c *model.Cycle) bool
+}
+
+// Reconciler is told about every live run that got txs mined.
+type Reconciler interface {
+	Reconcile(ctx context.Context, c *model.Cycle, res *model.RunResult) error
+}
+
+// Calibrator is told about every successful check, to compare it with the
+// graph's return.
+type Calibrator interface {
+	Simulated(c *model.Cycle, res *model.RunResult)
+}
+
+// Explainer describes a cycle hop by hop for logs and alerts.
+type Explainer interface {
+	Text(c *model.Cycle) string
+}
 
-	return &Scheduler{
+// updater is implemented by executors that adjust what they have in flight
+// for a cycle when its return changes.
+type updater interface {
+	Updated(c *model.Cycle, r float64)
+}
+
+func New(client *rpc.Client /*, xt texec*/, xl exec, enc *executor.Encoder, j *journal.Journal, m *metrics.Metrics /*, gas *gas.Tracker*/) *Scheduler {
+	s := &Scheduler{
 		client:  client,
-		checker: ch,
 		xLive:   xl,
+		journal: j,
 		cycles:  make(map[uint64]*model.Cycle),
 
 		newCycleCh: make(chan []*model.Cycle, 100),
@@ -66,9 +108,90 @@ func New(client *rpc.Client /*, xt texec*/, xl exec, m *metrics.Metrics /*, gas
 		updCycleCh: make(chan map[uint64]float64, 100),
 		resCycleCh: make(chan map[uint64]*model.RunResult, 100),
 
+		live:       make(map[uint64]*model.Cycle),
+		liveDoneCh: make(chan uint64, 100),
+		liveOn:     boolToInt32(Live),
+
 		metrics: m,
 		log:     m.WithField("context", "Scheduler"),
 	}
+
+	// without an executor contract the checker has to be set explicitly
+	if enc != nil {
+		ch, err := newChecker(client, enc, m)
+		if err != nil {
+			panic(err)
+		}
+		s.checker = ch
+	}
+
+	return s
+}
+
+func (s *Scheduler) SetChecker(ch Checker) {
+	s.checker = ch
+}
+
+// SetLive turns running cycles on or off, it is safe to call from any
+// goroutine.
+func (s *Scheduler) SetLive(on bool) {
+	atomic.StoreInt32(&s.liveOn, boolToInt32(on))
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *Scheduler) SetReconciler(r Reconciler) {
+	s.recon = r
+}
+
+func (s *Scheduler) SetCalibrator(cl Calibrator) {
+	s.calib = cl
+}
+
+func (s *Scheduler) SetExplainer(e Explainer) {
+	s.explain = e
+}
+
+func (s *Scheduler) describe(c *model.Cycle) string {
+	if s.explain == nil {
+		return fmt.Sprintf("%v\n%v", c.ParamAddrs, c.ParamAMMs)
+	}
+	return s.explain.Text(c)
+}
+
+// AddFilter makes the scheduler drop the cycles f refuses. Filters are
+// asked again before a cycle is run, what they know can change.
+func (s *Scheduler) AddFilter(f filter) {
+	s.filters = append(s.filters, f)
+}
+
+// AddLiveFilter makes the scheduler run only cycles f allows, without
+// dropping the others: they are still checked and journaled.
+func (s *Scheduler) AddLiveFilter(f filter) {
+	s.gates = append(s.gates, f)
+}
+
+func (s *Scheduler) liveAllowed(c *model.Cycle) bool {
+	for _, f := range s.gates {
+		if !f.Allow(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scheduler) allowed(c *model.Cycle) bool {
+	for _, f := range s.filters {
+		if !f.Allow(c) {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Scheduler) Add(c []*model.Cycle)          { s.newCycleCh <- c }
@@ -81,6 +204,10 @@ type triedCycleKey struct {
 }
 
 func (s *Scheduler) Start(ctx context.Context) error {
+	if s.checker == nil {
+		return errors.New("no checker")
+	}
+
 	badCycles := sync.Map{}
 	triedCycles := sync.Map{}
 
@@ -174,7 +301,13 @@ func (s *Scheduler) Start(ctx context.Context) error {
 				var maxReturnCycle *model.Cycle
 				var maxReturn float64
 
+				f, _ := s.xLive.(filter)
+
 				for _, c := range s.cycles {
+					if f != nil && !f.Allow(c) || !s.allowed(c) || !s.liveAllowed(c) || !s.independent(c) {
+						continue
+					}
+
 					if c.TestRes != nil && c.TestRes.Success && c.TestRes.Return != 0 {
 						if r := c.TestRes.Return; 1+r > model.AmtThreshs[c.Amt] &&
 							r > maxReturn &&
@@ -193,7 +326,7 @@ func (s *Scheduler) Start(ctx context.Context) error {
 					}
 				}
 
-				if !Live || s.xLive.Running() ||
+				if atomic.LoadInt32(&s.liveOn) == 0 || s.xLive.Running() ||
 					maxReturnCycle == nil ||
 					(!lastLiveTx.IsZero() && time.Now().Sub(lastLiveTx) < MIN_TX_WAIT_TIME) {
 
@@ -206,27 +339,64 @@ func (s *Scheduler) Start(ctx context.Context) error {
 				default:
 				}
 
-				s.log.Println("LIVE TX: starting   hash =", maxReturnCycle.Hash(), maxReturnCycle.Amt.String(), "return =", maxReturn)
-				res, err := s.xLive.Run(maxReturnCycle.Context, maxReturnCycle)
-				if err != nil {
-					s.log.WithError(err).Error("LIVE TX: failed   hash =", maxReturnCycle.Hash())
-					return
-				}
+				c := maxReturnCycle
+				s.live[c.Hash()] = c
+				lastLiveTx = time.Now()
 
-				triedCycles.LoadOrStore(triedCycleKey{R: maxReturn, H: maxReturnCycle.Hash()}, time.Now())
+				go func() {
+					defer func() { s.liveDoneCh <- c.Hash() }()
+
+					s.log.Println("LIVE TX: starting   hash =", c.Hash(), c.Amt.String(), "return =", maxReturn)
+					s.log.Println(s.describe(c))
+					s.journal.Sent(c, maxReturn)
+					res, err := s.xLive.Run(c.Context, c)
+					s.journal.Result(c, res, err)
+					if s.recon != nil && res != nil && len(res.Txs) > 0 {
+						ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+						if err := s.recon.Reconcile(ctx, c, res); err != nil {
+							s.log.WithError(err).Error("reconcile hash =", c.Hash())
+						}
+						cancel()
+					}
+					if executor.IsEncode(err) {
+						// nothing was sent, the executor definition does not fit the cycle
+						s.log.WithError(err).Error("LIVE TX: cannot encode, check the executor definition   hash =", c.Hash())
+						return
+					}
+					if err != nil {
+						slippage := executor.IsSlippage(err)
+						s.metrics.MetricRevert("live", slippage)
+						s.log.WithError(err).WithField("slippage", slippage).Error("LIVE TX: failed   hash =", c.Hash())
+						return
+					}
 
-				lastLiveTx = time.Now()
+					triedCycles.LoadOrStore(triedCycleKey{R: maxReturn, H: c.Hash()}, time.Now())
 
-				s.log.Printf("LIVE TX: SUCCESS  hash = %d success = %t\n", maxReturnCycle.Hash(), res.Success)
+					s.log.Printf("LIVE TX: SUCCESS  hash = %d success = %t\n", c.Hash(), res.Success)
+					if res.Success {
+						msg := "<b>trade included</b>\n<pre>" + html.EscapeString(s.describe(c)) + "</pre>"
+						if err := telegram.Message(time.Now(), msg, false); err != nil {
+							s.log.WithError(err).Error("telegram")
+						}
+					}
+				}()
 			}()
 
+		case h := <-s.liveDoneCh:
+			delete(s.live, h)
+
 		case mc := <-s.resCycleCh:
 			for c, r := range mc {
 				if cy, ok := s.cycles[c]; ok {
 					cy.TestRes = r
 					if r.Error != nil && strings.Contains(r.Error.Error(), "execution reverted: ") {
-						//badCycles[cy.Hash()] = true
-						badCycles.Store(cy.Hash(), true)
+						// reserves moved since detection, the cycle itself may be fine
+						slippage := executor.IsSlippage(r.Error)
+						s.metrics.MetricRevert("check", slippage)
+						if !slippage {
+							//badCycles[cy.Hash()] = true
+							badCycles.Store(cy.Hash(), true)
+						}
 					}
 				}
 			}
@@ -238,13 +408,25 @@ func (s *Scheduler) Start(ctx context.Context) error {
 
 		case mc := <-s.updCycleCh:
 			for c, r := range mc {
-				if cy, ok := s.cycles[c]; ok {
+				if cy, ok := s.cycles[c]; ok && cy.Return != r {
 					cy.Return = r
+					s.journal.Return(cy, r)
+
+					if u, ok := s.xLive.(updater); ok && s.live[c] != nil {
+						u.Updated(cy, r)
+					}
 				}
 			}
 
 		case cc := <-s.newCycleCh:
 			for _, c := range cc {
+				// removed while it was confirmed
+				if c.Context.Err() != nil || !s.allowed(c) {
+					continue
+				}
+				if _, ok := s.cycles[c.Hash()]; !ok {
+					s.journal.Detected(c)
+				}
 				s.cycles[c.Hash()] = c
 			}
 		}
@@ -261,30 +443,60 @@ func (s *Scheduler) Test(cy *model.Cycle, cb func()) {
 		defer cancel()
 
 		start := time.Now()
-		ret, err := s.checker.check(ctx, c.Amt.Int(), c.ParamAddrs, model.AMMStoParams(c.ParamAMMs), c.Hash())
+		res, err := s.checker.Check(ctx, c, nil)
 		dur := time.Now().Sub(start)
 
 		if err != nil {
 			fmt.Printf("TESTCYCLE:ERROR c=[%d] r=[%.5f] a=[%s] err=[%s] len=[%d] dur=[%v] \n", c.Hash(), c.Return, c.Amt.String(), err, len(c.ParamAddrs), dur)
-			fmt.Printf("%v\n%v\n", c.ParamAddrs, c.ParamAMMs)
+			fmt.Println(s.describe(c))
 
-			s.resCycleCh <- map[uint64]*model.RunResult{c.Hash(): {Error: err}}
+			res := &model.RunResult{Error: err}
+			s.journal.Tested(c, res)
+			s.resCycleCh <- map[uint64]*model.RunResult{c.Hash(): res}
 			cb()
 			return
 		}
 
-		fmt.Printf("TESTCYCLE:SUCCESS c=[%d] r=[%.5f] a=[%s] ret=[%.5f] len=[%d] dur=[%v] \n", c.Hash(), c.Return, c.Amt.String(), ret, len(c.ParamAddrs), dur)
-		fmt.Printf("%v\n%v\n", c.ParamAddrs, c.ParamAMMs)
+		fmt.Printf("TESTCYCLE:SUCCESS c=[%d] r=[%.5f] a=[%s] ret=[%.5f] len=[%d] dur=[%v] \n", c.Hash(), c.Return, c.Amt.String(), res.Return, len(c.ParamAddrs), dur)
+		fmt.Println(s.describe(c))
 
-		s.resCycleCh <- map[uint64]*model.RunResult{c.Hash(): {
-			Success: true,
-			Return:  ret,
-		}}
+		s.journal.Tested(c, res)
+		if s.calib != nil {
+			s.calib.Simulated(c, res)
+		}
+		s.resCycleCh <- map[uint64]*model.RunResult{c.Hash(): res}
 		cb()
 	}()
 
 }
 
+// independent reports whether c shares no token besides WETH with any cycle
+// currently being executed, so it can be submitted from another keeper.
+func (s *Scheduler) independent(c *model.Cycle) bool {
+	for h, l := range s.live {
+		if h == c.Hash() {
+			return false
+		}
+
+		for _, a := range l.ParamAddrs {
+			if a != model.WETHAddress && !c.DoesntInclude(a) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Simulate re-runs the checker for c against the state at block.
+func (s *Scheduler) Simulate(ctx context.Context, c *model.Cycle, block *big.Int) (float64, error) {
+	res, err := s.checker.Check(ctx, c, block)
+	if err != nil {
+		return 0, err
+	}
+	return res.Return, nil
+}
+
 //func (s *Scheduler) Test(c *model.Cycle) {
 //	ctx, cancel := context.WithTimeout(c.Context, 10*time.Second)
 //	defer cancel()
@@ -1,39 +1,50 @@
 package scheduler
 
 import (
-	"bytes"
 	"context"
 	"math/big"
 
+	"github.com/0xnibbler/mev-q4-2020/executor"
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/pkg/errors"
 )
 
-var contractAbi = []byte("")
+// AccessLists makes the checker generate an EIP-2930 access list for each
+// cycle, kept when it lowers the gas used.
+var AccessLists = true
 
 type checker struct {
 	c *rpc.Client
 
-	a    *abi.ABI
+	enc  *executor.Encoder
 	from common.Address
 	to   common.Address
+
+	metrics *metrics.Metrics
 }
 
-func newChecker(c *rpc.Client, from, to common.Address) (*checker, error) {
-	aFB, err := abi.JSON(bytes.NewReader(contractAbi))
+func newChecker(c *rpc.Client, enc *executor.Encoder, m *metrics.Metrics) (*checker, error) {
+	if enc == nil {
+		return nil, errors.New("checker: no executor")
+	}
 
-	return &checker{c: c, a: &aFB, from: from, to: to}, err
+	return &checker{c: c, enc: enc, from: enc.From, to: enc.Address, metrics: m}, nil
 }
 
-func (ch *checker) check(ctx context.Context, amtIn *big.Int, tokens []common.Address, dexes []*big.Int, hash uint64) (float64, error) {
-
-	data, err := ch.a.Pack("")
+// Check simulates c and returns its profit in eth, the gas it used and, for
+// checks against the pending state, the access list to send it with.
+func (ch *checker) Check(ctx context.Context, c *model.Cycle, block *big.Int) (*model.RunResult, error) {
+	data, err := ch.enc.Pack(c, &executor.Params{Block: block})
 	if err != nil {
-		return 0, errors.Wrap(err, "ch.a.Pack")
+		return nil, errors.Wrap(err, "ch.enc.Pack")
 	}
 
 	/*
@@ -50,10 +61,78 @@ func (ch *checker) check(ctx context.Context, amtIn *big.Int, tokens []common.Ad
 		fmt.Println("CHECKER", "P", gasP, "L", gasL, "P==L", gasP == gasL, hash, endP.Sub(startP), time.Now().Sub(endP))
 	*/
 
-	return ch.call(ctx, ch.from, ch.to, nil, 1500000, data)
+	// the access list takes two more round trips, run them alongside the
+	// call so the check stays within its timeout
+	var alc chan accessListResult
+	if block == nil && AccessLists {
+		alc = make(chan accessListResult, 1)
+		go func() {
+			var r accessListResult
+			r.al, r.gas, r.err = ch.accessList(ctx, ch.from, ch.to, 1500000, data)
+			alc <- r
+		}()
+	}
+
+	ret, gas, err := ch.call(ctx, ch.from, ch.to, nil, 1500000, data, block)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &model.RunResult{Success: true, Return: ret, GasUsed: gas}
+
+	if alc != nil {
+		r := <-alc
+		if r.err == nil && r.gas < gas {
+			res.AccessList = r.al
+			res.GasUsed = r.gas
+			ch.metrics.MetricAccessList(len(c.Path), gas-r.gas, true)
+		} else if r.err == nil {
+			ch.metrics.MetricAccessList(len(c.Path), 0, false)
+		}
+	}
+
+	return res, nil
+}
+
+type accessListResult struct {
+	al  types.AccessList
+	gas uint64
+	err error
+}
+
+// accessList asks the node for the storage c touches and estimates the gas
+// of the call when those slots are declared up front. The list is for from,
+// the executor's caller in the definition; live txs sent by another keeper
+// have it generated again for their sender.
+func (ch *checker) accessList(ctx context.Context, from, to common.Address, gas uint64, data []byte) (types.AccessList, uint64, error) {
+	msg := ethereum.CallMsg{
+		From: from,
+		To:   &to,
+		Gas:  gas,
+		Data: data,
+	}
+
+	al, _, vmErr, err := gethclient.New(ch.c).CreateAccessList(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if vmErr != "" {
+		return nil, 0, errors.New(vmErr)
+	}
+	if al == nil || len(*al) == 0 {
+		return nil, 0, errors.New("empty access list")
+	}
+
+	msg.AccessList = *al
+	est, err := ethclient.NewClient(ch.c).EstimateGas(ctx, msg)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "estimate gas")
+	}
+
+	return *al, est, nil
 }
 
-func (ch *checker) call(ctx context.Context, from, to common.Address, value *big.Int, gas uint64, data []byte) (latest float64, err error) {
+func (ch *checker) call(ctx context.Context, from, to common.Address, value *big.Int, gas uint64, data []byte, block *big.Int) (latest float64, gasUsed uint64, err error) {
 	client := ethclient.NewClient(ch.c)
 
 	msg := ethereum.CallMsg{
@@ -66,15 +145,24 @@ func (ch *checker) call(ctx context.Context, from, to common.Address, value *big
 		AccessList: nil,
 	}
 
-	c, err := client.CallContract(ctx, msg, nil)
+	c, err := client.CallContract(ctx, msg, block)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	cRes, err := ch.a.Unpack("swap", c)
+	profit, err := ch.enc.Unpack(c)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(profit), big.NewFloat(1e+18)).Float64()
+
+	// estimates always run against pending state, skip them for historic checks
+	if block == nil {
+		if gasUsed, err = client.EstimateGas(ctx, msg); err != nil {
+			return 0, 0, errors.Wrap(err, "estimate gas")
+		}
 	}
 
-	return float64(cRes[0].(*big.Int).Int64()) / 1e+18, nil
+	return f, gasUsed, nil
 }
@@ -0,0 +1,280 @@
+// Package signer holds the keys the bot signs with: the relay auth identity
+// and the keeper accounts. A signer is given as a spec:
+//
+//	keystore:<file>             encrypted keystore, passphrase from Passphrase
+//	<file>                      same as keystore:<file>
+//	external:<endpoint>@<addr>  clef compatible signer on an ipc socket or http url
+//
+// Key material is never printed; a Signer only formats as its address.
+package signer
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/external"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+type Signer interface {
+	Address() common.Address
+
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+
+	// SignText signs the EIP-191 personal message hash of text and returns
+	// the signature with v as 0 or 1.
+	SignText(text []byte) ([]byte, error)
+}
+
+// Passphrase is where keystore passphrases are read from: env:<NAME>,
+// file:<path> or fd:<n>.
+var Passphrase = "env:PASSPHRASE"
+
+var (
+	passOnce sync.Once
+	pass     string
+	passErr  error
+)
+
+// passphrase resolves Passphrase once; a file descriptor can only be read
+// a single time.
+func passphrase() (string, error) {
+	passOnce.Do(func() {
+		kind, arg := split(Passphrase)
+
+		switch kind {
+		case "env":
+			pass = os.Getenv(arg)
+		case "file":
+			var b []byte
+			b, passErr = ioutil.ReadFile(arg)
+			pass = strings.TrimRight(string(b), "\r\n")
+		case "fd":
+			fd, err := strconv.Atoi(arg)
+			if err != nil {
+				passErr = errors.Wrap(err, "passphrase fd")
+				return
+			}
+
+			f := os.NewFile(uintptr(fd), "passphrase")
+			defer f.Close()
+
+			var b []byte
+			b, passErr = ioutil.ReadAll(f)
+			pass = strings.TrimRight(string(b), "\r\n")
+		default:
+			passErr = fmt.Errorf("passphrase: unknown source %q", kind)
+		}
+	})
+
+	return pass, passErr
+}
+
+func split(spec string) (string, string) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return "", spec
+	}
+	return spec[:i], spec[i+1:]
+}
+
+// Open returns the signer described by spec.
+func Open(spec string) (Signer, error) {
+	kind, arg := split(spec)
+
+	switch kind {
+	case "", "keystore":
+		k, err := ReadKeystore(arg)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	case "external":
+		i := strings.LastIndex(arg, "@")
+		if i < 0 || !common.IsHexAddress(arg[i+1:]) {
+			return nil, fmt.Errorf("signer: %q: want external:<endpoint>@<address>", spec)
+		}
+		e, err := NewExternal(arg[:i], common.HexToAddress(arg[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	// a windows path or a path with a colon in it
+	k, err := ReadKeystore(spec)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// OpenOrCreate is Open, except that a keystore spec whose file does not
+// exist yet gets a new key, see LoadOrCreate.
+func OpenOrCreate(spec string) (s Signer, created bool, err error) {
+	kind, arg := split(spec)
+	if kind != "" && kind != "keystore" {
+		s, err := Open(spec)
+		return s, false, err
+	}
+
+	k, created, err := LoadOrCreate(arg)
+	if err != nil {
+		return nil, false, err
+	}
+	return k, created, nil
+}
+
+// Key signs with a private key held in memory.
+type Key struct {
+	addr common.Address
+	key  *ecdsa.PrivateKey
+}
+
+func FromKey(k *ecdsa.PrivateKey) *Key {
+	return &Key{addr: crypto.PubkeyToAddress(k.PublicKey), key: k}
+}
+
+func ReadKeystore(file string) (*Key, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := keystore.DecryptKey(b, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "keystore "+file)
+	}
+
+	return FromKey(k.PrivateKey), nil
+}
+
+// LoadOrCreate reads the keystore at file, or generates a key and stores it
+// there encrypted with the passphrase if the file does not exist yet.
+func LoadOrCreate(file string) (key *Key, created bool, err error) {
+	if _, err := os.Stat(file); err == nil {
+		key, err := ReadKeystore(file)
+		return key, false, err
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	p, err := passphrase()
+	if err != nil {
+		return nil, false, err
+	}
+
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, false, err
+	}
+
+	k := FromKey(pk)
+	b, err := keystore.EncryptKey(&keystore.Key{
+		Address:    k.addr,
+		PrivateKey: pk,
+	}, p, keystore.StandardScryptN, keystore.StandardScryptP)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, false, err
+	}
+
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		return nil, false, err
+	}
+
+	return k, true, nil
+}
+
+func (k *Key) Address() common.Address {
+	return k.addr
+}
+
+func (k *Key) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), k.key)
+}
+
+func (k *Key) SignText(text []byte) ([]byte, error) {
+	return crypto.Sign(accounts.TextHash(text), k.key)
+}
+
+func (k *Key) String() string {
+	return "key(" + k.addr.Hex() + ")"
+}
+
+func (k *Key) GoString() string {
+	return k.String()
+}
+
+// External forwards signing requests to a clef compatible signer.
+type External struct {
+	acc accounts.Account
+	api *external.ExternalSigner
+}
+
+func NewExternal(endpoint string, addr common.Address) (*External, error) {
+	api, err := external.NewExternalSigner(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "external signer "+endpoint)
+	}
+
+	acc := accounts.Account{Address: addr}
+	if !api.Contains(acc) {
+		return nil, fmt.Errorf("external signer %s: no account %s", endpoint, addr.Hex())
+	}
+
+	return &External{acc: acc, api: api}, nil
+}
+
+func (e *External) Address() common.Address {
+	return e.acc.Address
+}
+
+func (e *External) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	stx, err := e.api.SignTx(e.acc, tx, chainID)
+	if err != nil {
+		return nil, err
+	}
+
+	// do not trust the signer to have signed what was asked for: the
+	// signing hash covers type, chain, nonce, fees, gas, to, value, data
+	// and access list
+	s := types.LatestSignerForChainID(chainID)
+	from, err := types.Sender(s, stx)
+	if err != nil {
+		return nil, err
+	}
+	if from != e.acc.Address || s.Hash(stx) != s.Hash(tx) {
+		return nil, errors.New("external signer returned a different tx")
+	}
+
+	return stx, nil
+}
+
+func (e *External) SignText(text []byte) ([]byte, error) {
+	return e.api.SignText(e.acc, text)
+}
+
+func (e *External) String() string {
+	return "external(" + e.acc.Address.Hex() + ")"
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/0xnibbler/mev-q4-2020/metrics"
+	"github.com/0xnibbler/mev-q4-2020/tokens"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenListCmd imports token lists into tokens.json or exports it as one:
+//
+//	tokenlist import <list|url>...   earlier lists take precedence
+//	tokenlist export [-name n] [-version 1.0.0] [-o file]
+func tokenListCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("want import or export")
+	}
+
+	fs := flag.NewFlagSet("tokenlist "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "mev", "exported list name")
+	version := fs.String("version", "1.0.0", "exported list version")
+	out := fs.String("o", "", "output file (default stdout)")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	m := metrics.New()
+	m.FieldLogger = logrus.New()
+	l := tokens.NewList(nil, m)
+
+	switch args[0] {
+	case "import":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("no token lists")
+		}
+
+		var lists []*tokens.TokenList
+		for _, src := range fs.Args() {
+			tl, err := tokens.ReadTokenList(src)
+			if err != nil {
+				return err
+			}
+			lists = append(lists, tl)
+		}
+
+		fmt.Fprintln(os.Stderr, "new tokens:", l.Import(lists...))
+		return l.Save()
+
+	case "export":
+		v, err := parseVersion(*version)
+		if err != nil {
+			return err
+		}
+
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			file, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+
+		return l.Export(*name, v).Write(w)
+	}
+
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func parseVersion(s string) (tokens.ListVersion, error) {
+	var v tokens.ListVersion
+
+	pp := strings.Split(s, ".")
+	if len(pp) != 3 {
+		return v, fmt.Errorf("bad version %q", s)
+	}
+
+	for i, dst := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		n, err := strconv.Atoi(pp[i])
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("bad version %q", s)
+		}
+		*dst = n
+	}
+
+	return v, nil
+}
+
+func splitTags(s string) []string {
+	var tt []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tt = append(tt, t)
+		}
+	}
+	return tt
+}
@@ -0,0 +1,411 @@
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ExcludeOwnerControlled makes List.Allow refuse cycles through tokens
+	// whose owner can change how they transfer.
+	ExcludeOwnerControlled = true
+
+	// TrustedTokens are allowed whatever their owner can do.
+	TrustedTokens = map[common.Address]bool{
+		model.WETHAddress: true,
+		model.USDCAddress: true,
+		model.USDTAddress: true,
+		model.WBTCAddress: true,
+		model.LINKAddress: true,
+	}
+)
+
+type Capability string
+
+const (
+	CanMint      Capability = "mint"
+	CanPause     Capability = "pause"
+	CanBlacklist Capability = "blacklist"
+	CanSetFees   Capability = "fees"
+	CanUpgrade   Capability = "upgrade"
+	Owned        Capability = "owned"
+)
+
+// dangerous maps the functions an owner can change a token with to what they
+// let the owner do.
+var dangerous = map[string]Capability{
+	"mint(address,uint256)":   CanMint,
+	"mint(uint256)":           CanMint,
+	"mintTo(address,uint256)": CanMint,
+	"issue(uint256)":          CanMint,
+
+	"pause()":                  CanPause,
+	"unpause()":                CanPause,
+	"setPaused(bool)":          CanPause,
+	"enableTrading()":          CanPause,
+	"openTrading()":            CanPause,
+	"setTradingEnabled(bool)":  CanPause,
+	"setMaxTxAmount(uint256)":  CanPause,
+	"setMaxTxPercent(uint256)": CanPause,
+
+	"blacklist(address)":               CanBlacklist,
+	"addBlackList(address)":            CanBlacklist,
+	"addToBlacklist(address)":          CanBlacklist,
+	"setBlacklist(address,bool)":       CanBlacklist,
+	"blacklistAddress(address,bool)":   CanBlacklist,
+	"freeze(address)":                  CanBlacklist,
+	"setBots(address[])":               CanBlacklist,
+	"destroyBlackFunds(address)":       CanBlacklist,
+	"updateBlacklister(address)":       CanBlacklist,
+	"excludeFromReward(address)":       CanBlacklist,
+	"setExcludedFromTransfer(address)": CanBlacklist,
+
+	"setFee(uint256)":                 CanSetFees,
+	"setFees(uint256,uint256)":        CanSetFees,
+	"setParams(uint256,uint256)":      CanSetFees,
+	"setTaxFeePercent(uint256)":       CanSetFees,
+	"setLiquidityFeePercent(uint256)": CanSetFees,
+	"setBuyFee(uint256)":              CanSetFees,
+	"setSellFee(uint256)":             CanSetFees,
+	"excludeFromFee(address)":         CanSetFees,
+	"setSwapAndLiquifyEnabled(bool)":  CanSetFees,
+
+	"upgradeTo(address)":              CanUpgrade,
+	"upgradeToAndCall(address,bytes)": CanUpgrade,
+	"changeAdmin(address)":            CanUpgrade,
+
+	"owner()":                    Owned,
+	"getOwner()":                 Owned,
+	"transferOwnership(address)": Owned,
+	"admin()":                    Owned,
+}
+
+var dangerousBySel = func() map[[4]byte]string {
+	m := make(map[[4]byte]string, len(dangerous))
+	for sig := range dangerous {
+		var s [4]byte
+		copy(s[:], selector(sig))
+		m[s] = sig
+	}
+	return m
+}()
+
+// proxy slots
+var (
+	slotEIP1967Impl   = common.HexToHash("0x360894a13ba1a3210667c828492db98dca3e2076cc3735a920a3ca505d382bbc")
+	slotEIP1967Beacon = common.HexToHash("0xa3f0ad74e5423aebfd80d3ef4346578335a9a72aeaee59ff6cb3582b35133d50")
+	slotEIP1967Admin  = common.HexToHash("0xb53127684a568b3173ae13b9f8a6016e243e63b6e8ee1178d6a717850b5d6103")
+	slotEIP1822       = crypto.Keccak256Hash([]byte("PROXIABLE"))
+	slotZeppelinOS    = crypto.Keccak256Hash([]byte("org.zeppelinos.proxy.implementation"))
+	slotZeppelinAdmin = crypto.Keccak256Hash([]byte("org.zeppelinos.proxy.admin"))
+
+	eip1167Prefix = common.FromHex("0x363d3d373d3d3d363d73")
+	eip1167Suffix = common.FromHex("0x5af43d82803e903d91602b57fd5bf3")
+
+	selImplementation = selector("implementation()")
+	selOwner          = selector("owner()")
+)
+
+// maxProxyDepth is how many proxies are followed to reach the code that
+// runs.
+const maxProxyDepth = 3
+
+// Code is what the bytecode of a token, and the implementations it
+// delegates to, let its owner do.
+type Code struct {
+	Hash common.Hash `json:"hash"`
+
+	Proxy          string         `json:"proxy,omitempty"`
+	Implementation common.Address `json:"implementation,omitempty"`
+	Admin          common.Address `json:"admin,omitempty"`
+
+	Capabilities []Capability `json:"capabilities,omitempty"`
+	Functions    []string     `json:"functions,omitempty"`
+
+	// Owner is the result of owner(), zero when it was renounced or the
+	// token has none. OwnerUnknown is set when the call failed or returned
+	// no address, the owner may then still be there.
+	Owner        common.Address `json:"owner,omitempty"`
+	OwnerUnknown bool           `json:"owner_unknown,omitempty"`
+
+	Block uint64 `json:"block"`
+}
+
+func (c *Code) Has(cp Capability) bool {
+	for _, x := range c.Capabilities {
+		if x == cp {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnerControlled reports whether someone can still change whether and how
+// the token transfers: pause it, blacklist holders, change its fees or
+// replace its code.
+func (c *Code) OwnerControlled() bool {
+	if c == nil {
+		return false
+	}
+	if c.Has(CanUpgrade) {
+		return true
+	}
+	if c.Owner == (common.Address{}) && !c.OwnerUnknown && c.Has(Owned) {
+		return false
+	}
+	return c.Has(CanPause) || c.Has(CanBlacklist) || c.Has(CanSetFees)
+}
+
+// Analyser reads token bytecode.
+type Analyser struct {
+	c *ethclient.Client
+}
+
+func NewAnalyser(c *ethclient.Client) *Analyser {
+	return &Analyser{c: c}
+}
+
+// Analyse fetches the code of token a, follows it through proxies and
+// collects the functions it has that an owner can abuse.
+func (an *Analyser) Analyse(ctx context.Context, a common.Address) (*Code, error) {
+	head, err := an.c.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	block := head.Number
+
+	code, err := an.c.CodeAt(ctx, a, block)
+	if err != nil {
+		return nil, errors.Wrap(err, "analyse: getCode")
+	}
+	if len(code) == 0 {
+		return nil, errors.Errorf("analyse: %s has no code", a.Hex())
+	}
+
+	res := &Code{Hash: crypto.Keccak256Hash(code), Block: block.Uint64()}
+	caps := make(map[Capability]bool)
+	fns := make(map[string]bool)
+
+	cur := a
+	for depth := 0; ; depth++ {
+		for sig := range functions(code) {
+			fns[sig] = true
+			caps[dangerous[sig]] = true
+		}
+
+		if depth == maxProxyDepth {
+			break
+		}
+
+		kind, impl, err := an.proxy(ctx, cur, code, block)
+		if err != nil {
+			return nil, err
+		}
+		if impl == (common.Address{}) {
+			break
+		}
+
+		if depth == 0 {
+			res.Proxy = kind
+			if kind != "eip1167" {
+				caps[CanUpgrade] = true
+			}
+			slot := slotEIP1967Admin
+			if kind == "zeppelinos" {
+				slot = slotZeppelinAdmin
+			}
+			admin, err := an.c.StorageAt(ctx, a, slot, block)
+			if err != nil {
+				return nil, errors.Wrap(err, "analyse: admin slot")
+			}
+			res.Admin = common.BytesToAddress(admin)
+		}
+		res.Implementation = impl
+
+		if code, err = an.c.CodeAt(ctx, impl, block); err != nil {
+			return nil, errors.Wrap(err, "analyse: getCode implementation")
+		}
+		cur = impl
+	}
+
+	for cp := range caps {
+		res.Capabilities = append(res.Capabilities, cp)
+	}
+	sort.Slice(res.Capabilities, func(i, j int) bool { return res.Capabilities[i] < res.Capabilities[j] })
+
+	for sig := range fns {
+		res.Functions = append(res.Functions, sig)
+	}
+	sort.Strings(res.Functions)
+
+	if caps[Owned] {
+		// called on the token, proxies delegate it
+		out, err := an.c.CallContract(ctx, ethereum.CallMsg{To: &a, Data: selOwner}, block)
+		if err == nil && len(out) == 32 {
+			res.Owner = common.BytesToAddress(out)
+		} else {
+			res.OwnerUnknown = true
+		}
+	}
+
+	return res, nil
+}
+
+// proxy returns the kind of proxy at a and the implementation it delegates
+// to, a zero address if it is none.
+func (an *Analyser) proxy(ctx context.Context, a common.Address, code []byte, block *big.Int) (string, common.Address, error) {
+	if n := len(eip1167Prefix) + 20; len(code) == n+len(eip1167Suffix) &&
+		bytes.HasPrefix(code, eip1167Prefix) && bytes.HasSuffix(code, eip1167Suffix) {
+		return "eip1167", common.BytesToAddress(code[len(eip1167Prefix):n]), nil
+	}
+
+	for _, s := range []struct {
+		kind string
+		slot common.Hash
+	}{
+		{"eip1967", slotEIP1967Impl},
+		{"eip1822", slotEIP1822},
+		{"zeppelinos", slotZeppelinOS},
+	} {
+		v, err := an.c.StorageAt(ctx, a, s.slot, block)
+		if err != nil {
+			return "", common.Address{}, errors.Wrap(err, "analyse: "+s.kind+" slot")
+		}
+		if impl := common.BytesToAddress(v); impl != (common.Address{}) {
+			return s.kind, impl, nil
+		}
+	}
+
+	v, err := an.c.StorageAt(ctx, a, slotEIP1967Beacon, block)
+	if err != nil {
+		return "", common.Address{}, errors.Wrap(err, "analyse: beacon slot")
+	}
+	if beacon := common.BytesToAddress(v); beacon != (common.Address{}) {
+		out, err := an.c.CallContract(ctx, ethereum.CallMsg{To: &beacon, Data: selImplementation}, block)
+		if err != nil || len(out) != 32 {
+			return "", common.Address{}, errors.Errorf("analyse: beacon %s has no implementation", beacon.Hex())
+		}
+		return "eip1967-beacon", common.BytesToAddress(out), nil
+	}
+
+	return "", common.Address{}, nil
+}
+
+// functions returns the known dangerous functions whose selectors code
+// pushes, which is how solidity dispatchers compare them. Selectors with
+// leading zero bytes are pushed with fewer than four.
+func functions(code []byte) map[string]bool {
+	fns := make(map[string]bool)
+
+	for i := 0; i < len(code); i++ {
+		op := vm.OpCode(code[i])
+		if op < vm.PUSH1 || op > vm.PUSH32 {
+			continue
+		}
+
+		n := int(op-vm.PUSH1) + 1
+		if op <= vm.PUSH4 && i+n < len(code) {
+			var s [4]byte
+			copy(s[4-n:], code[i+1:i+1+n])
+			if sig, ok := dangerousBySel[s]; ok {
+				fns[sig] = true
+			}
+		}
+		i += n
+	}
+
+	return fns
+}
+
+// Analyse runs an on every listed token that was not analysed yet, or all
+// of them with force.
+func (l *List) Analyse(ctx context.Context, an *Analyser, force bool) error {
+	l.tokensLock.RLock()
+	var todo []*Token
+	for _, t := range l.tokens {
+		if force || t.Code == nil {
+			todo = append(todo, t)
+		}
+	}
+	l.tokensLock.RUnlock()
+
+	pool := make(chan struct{}, 20)
+	wg := sync.WaitGroup{}
+
+	var failed, controlled int
+	var lock sync.Mutex
+
+	for _, t := range todo {
+		t := t
+		wg.Add(1)
+		pool <- struct{}{}
+		go func() {
+			defer func() {
+				<-pool
+				wg.Done()
+			}()
+
+			c, err := an.Analyse(ctx, t.Address)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				failed++
+				l.log.WithField("token", t.Address.Hex()).WithError(err).Debugln("analyse")
+				return
+			}
+			if c.OwnerControlled() {
+				controlled++
+			}
+
+			l.tokensLock.Lock()
+			t.Code = c
+			l.tokensLock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	l.log.Printf("analysed %d tokens, %d owner controlled, %d failed", len(todo), controlled, failed)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return l.Save()
+}
+
+// Allow refuses cycles through tokens the scanner found unsafe, whose tags
+// are not allowed and, with ExcludeOwnerControlled, through untrusted tokens
+// whose owner controls their transfers. Unlisted and not yet analysed
+// tokens pass.
+func (l *List) Allow(c *model.Cycle) bool {
+	l.tokensLock.RLock()
+	defer l.tokensLock.RUnlock()
+
+	for _, a := range c.ParamAddrs {
+		t := l.tokens[a]
+		if t == nil || TrustedTokens[a] {
+			continue
+		}
+		if !t.TagsAllowed() || t.Risk != nil && !t.Risk.Safe() {
+			return false
+		}
+		if ExcludeOwnerControlled && t.Code.OwnerControlled() {
+			return false
+		}
+	}
+
+	return true
+}
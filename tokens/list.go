@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"sync"
@@ -20,6 +21,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -95,6 +97,36 @@ func (l *List) Add(ctx context.Context, a common.Address) error {
 	return nil
 }
 
+// AddMany adds the tokens of aa that are not listed yet, reading their
+// metadata in batches. It returns the ones that could not be read.
+func (l *List) AddMany(ctx context.Context, aa []common.Address) []common.Address {
+	var todo []common.Address
+	seen := make(map[common.Address]bool)
+	for _, a := range aa {
+		if !seen[a] && l.ByAddr(a) == nil {
+			todo = append(todo, a)
+		}
+		seen[a] = true
+	}
+
+	var failed []common.Address
+	tt := GetMany(ctx, l.c, todo)
+
+	l.tokensLock.Lock()
+	for i, t := range tt {
+		if t == nil {
+			failed = append(failed, todo[i])
+			continue
+		}
+		if _, ok := l.tokens[t.Address]; !ok {
+			l.tokens[t.Address] = t
+		}
+	}
+	l.tokensLock.Unlock()
+
+	return failed
+}
+
 func (l *List) SetAmts(ctx context.Context) ([]common.Address, error) {
 	l.tokensLock.Lock()
 
@@ -251,6 +283,38 @@ func (l *List) SetAmt(t common.Address, amt *big.Int, a model.AMT, amm model.AMM
 	return
 }
 
+// Scan runs s on token a unless it was scanned before and stores the result
+// on the token.
+func (l *List) Scan(ctx context.Context, s *Scanner, a common.Address) (*Risk, error) {
+	t := l.ByAddr(a)
+	if t == nil {
+		return nil, fmt.Errorf("tokenlist: %s not listed", a.Hex())
+	}
+
+	l.tokensLock.RLock()
+	r := t.Risk
+	l.tokensLock.RUnlock()
+	if r != nil {
+		return r, nil
+	}
+
+	r, err := s.Scan(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Flags) > 0 {
+		l.log.WithField("token", a.Hex()).Warnf("%s: %v buy %.4f transfer %.4f sell %.4f",
+			t.Symbol, r.Flags, r.BuyTax, r.TransferTax, r.SellTax)
+	}
+
+	l.tokensLock.Lock()
+	t.Risk = r
+	l.tokensLock.Unlock()
+
+	return r, nil
+}
+
 func (l *List) ByAddr(a common.Address) *Token {
 	l.tokensLock.Lock()
 	defer l.tokensLock.Unlock()
@@ -258,31 +322,22 @@ func (l *List) ByAddr(a common.Address) *Token {
 	return l.tokens[a]
 }
 
-type loadToken struct {
-	Address  string `json:"address"`
-	Name     string `json:"name"`
-	Symbol   string `json:"symbol"`
-	Decimals int    `json:"decimals"`
-	ChainID  int    `json:"chain_id"`
-}
-
+// tryLoad reads what Save wrote: the tokens keyed by address.
 func (l *List) tryLoad() {
-	q := make(map[string]loadToken)
+	q := make(map[common.Address]*Token)
 
 	f, err := os.Open(listFile)
 	if err == nil {
 		defer f.Close()
-		if err = json.NewDecoder(f).Decode(&q); err != nil {
+		if err = json.NewDecoder(f).Decode(&q); err != nil && err != io.EOF {
 			l.log.Println("read tokens:", err)
 		}
 		for k, v := range q {
-			l.tokens[common.HexToAddress(k)] = &Token{
-				Address:  common.HexToAddress(k),
-				Name:     v.Name,
-				Symbol:   v.Symbol,
-				Decimals: v.Decimals,
-				ChainID:  v.ChainID,
+			if v == nil {
+				continue
 			}
+			v.Address = k
+			l.tokens[k] = v
 		}
 
 	} else if os.IsNotExist(err) {
@@ -294,7 +349,7 @@ func (l *List) tryLoad() {
 }
 
 func (l *List) Save() error {
-	f, err := os.OpenFile(listFile, os.O_RDWR|os.O_CREATE, 0644)
+	f, err := os.OpenFile(listFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -303,6 +358,9 @@ func (l *List) Save() error {
 	e := json.NewEncoder(f)
 	e.SetIndent("", "\t")
 
+	l.tokensLock.RLock()
+	defer l.tokensLock.RUnlock()
+
 	l.log.Println("token list saving len =", len(l.tokens))
 
 	return e.Encode(l.tokens)
@@ -310,19 +368,24 @@ func (l *List) Save() error {
 
 var transferSig = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
 
+// TokenTransferSubsFn is told about transfers of token into (in) or out of
+// a watched addr. A transfer between two watched addresses is reported for
+// both.
 type TokenTransferSubsFn interface {
-	Transfer(in bool, addr common.Address, amt *big.Int)
+	Transfer(token common.Address, in bool, addr common.Address, amt *big.Int)
 }
 
+// SubscribeTransfers follows the Transfer events of tokenAddrs, or of all
+// tokens if it is empty, from or to watchAddr. The addresses are filtered on
+// by the node, through the indexed from and to topics.
 func (l *List) SubscribeTransfers(ctx context.Context, tokenAddrs []common.Address, watchAddr []common.Address, fn TokenTransferSubsFn) error {
-	query := ethereum.FilterQuery{
-		Addresses: tokenAddrs,
-		Topics:    [][]common.Hash{{transferSig}},
+	if len(watchAddr) == 0 {
+		return errors.New("subscribe transfers: no addresses")
 	}
 
-	watchMap := make(map[common.Address]struct{})
-	for _, a := range watchAddr {
-		watchMap[a] = struct{}{}
+	watch := make([]common.Hash, len(watchAddr))
+	for i, a := range watchAddr {
+		watch[i] = a.Hash()
 	}
 
 	fil, err := weth.NewWETHFilterer(common.Address{}, nil)
@@ -330,44 +393,48 @@ func (l *List) SubscribeTransfers(ctx context.Context, tokenAddrs []common.Addre
 		return err
 	}
 
-	logs := make(chan types.Log)
-	defer close(logs)
+	// topics of one query all have to match, so transfers out and in are
+	// two subscriptions; one between two watched addresses is in both
+	outLogs, inLogs := make(chan types.Log), make(chan types.Log)
+
+	outSub, err := l.c.SubscribeFilterLogs(ctx, ethereum.FilterQuery{
+		Addresses: tokenAddrs,
+		Topics:    [][]common.Hash{{transferSig}, watch},
+	}, outLogs)
+	if err != nil {
+		return err
+	}
+	defer outSub.Unsubscribe()
 
-	sub, err := l.c.SubscribeFilterLogs(ctx, query, logs)
+	inSub, err := l.c.SubscribeFilterLogs(ctx, ethereum.FilterQuery{
+		Addresses: tokenAddrs,
+		Topics:    [][]common.Hash{{transferSig}, nil, watch},
+	}, inLogs)
 	if err != nil {
 		return err
 	}
+	defer inSub.Unsubscribe()
 
 	for {
 		select {
-		case err := <-sub.Err():
+		case err := <-outSub.Err():
+			return err
+
+		case err := <-inSub.Err():
 			return err
 
 		case <-ctx.Done():
 			return nil
 
-		case vLog := <-logs:
-			switch vLog.Topics[0] {
-			case transferSig:
-				event, err := fil.ParseTransfer(vLog)
-				if err != nil {
-					return err
-				}
-
-				_, in := watchMap[event.Dst]
-				_, out := watchMap[event.Src]
-				if !in && !out {
-					continue
-				}
-
-				addr := event.Dst
-				if out {
-					addr = event.Src
-				}
+		case vLog := <-outLogs:
+			// tokens with unindexed Transfer args do not parse
+			if event, err := fil.ParseTransfer(vLog); err == nil {
+				fn.Transfer(vLog.Address, false, event.Src, event.Wad)
+			}
 
-				fn.Transfer(in, addr, event.Wad)
-			default:
-				continue
+		case vLog := <-inLogs:
+			if event, err := fil.ParseTransfer(vLog); err == nil {
+				fn.Transfer(vLog.Address, true, event.Dst, event.Wad)
 			}
 		}
 	}
@@ -0,0 +1,216 @@
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+)
+
+var (
+	// MulticallAddress is Multicall2, its tryAggregate lets single calls
+	// fail.
+	MulticallAddress = common.HexToAddress("0x5BA1e12693Dc8F9c48aAD8770482f4739bEeD696")
+
+	// MetaBatch is how many tokens' metadata is read per multicall.
+	MetaBatch = 200
+
+	// DefaultDecimals is assumed for tokens without decimals().
+	DefaultDecimals = 18
+)
+
+const multicallABI = `[{"inputs":[{"internalType":"bool","name":"requireSuccess","type":"bool"},{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall2.Call[]","name":"calls","type":"tuple[]"}],"name":"tryAggregate","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall2.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"nonpayable","type":"function"}]`
+
+var (
+	selName     = selector("name()")
+	selSymbol   = selector("symbol()")
+	selDecimals = selector("decimals()")
+
+	multicall = func() abi.ABI {
+		a, err := abi.JSON(strings.NewReader(multicallABI))
+		if err != nil {
+			panic(err)
+		}
+		return a
+	}()
+
+	stringArgs = func() abi.Arguments {
+		t, _ := abi.NewType("string", "", nil)
+		return abi.Arguments{{Type: t}}
+	}()
+)
+
+type mcCall struct {
+	Target   common.Address
+	CallData []byte
+}
+
+type mcResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+// meta is the raw output of name, symbol and decimals, nil for a call that
+// failed.
+type meta [3][]byte
+
+// token decodes m. name and symbol may be strings or bytes32, and any of
+// the three may be missing as long as one is there; what had to be made up
+// is listed in Inferred.
+func (m meta) token(a common.Address) (*Token, error) {
+	t := &Token{Address: a, ChainID: 1}
+
+	name, nameOk := decodeString(m[0])
+	symbol, symbolOk := decodeString(m[1])
+	decimals, decimalsOk := decodeDecimals(m[2])
+
+	if !nameOk && !symbolOk && !decimalsOk {
+		return nil, errors.Errorf("tl: %s: no erc20 metadata", a.Hex())
+	}
+
+	switch {
+	case nameOk:
+		t.Name = name
+	case symbolOk:
+		t.Name = symbol
+		t.Inferred = append(t.Inferred, "name")
+	default:
+		t.Name = a.Hex()
+		t.Inferred = append(t.Inferred, "name")
+	}
+
+	switch {
+	case symbolOk:
+		t.Symbol = symbol
+	case nameOk:
+		t.Symbol = name
+		t.Inferred = append(t.Inferred, "symbol")
+	default:
+		t.Symbol = a.Hex()[:8]
+		t.Inferred = append(t.Inferred, "symbol")
+	}
+
+	t.Decimals = decimals
+	if !decimalsOk {
+		t.Decimals = DefaultDecimals
+		t.Inferred = append(t.Inferred, "decimals")
+	}
+
+	return t, nil
+}
+
+func decodeString(b []byte) (string, bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+
+	if v, err := stringArgs.Unpack(b); err == nil {
+		if s, ok := v[0].(string); ok && s != "" && utf8.ValidString(s) {
+			return s, true
+		}
+	}
+
+	// MKR style bytes32
+	if len(b) == 32 {
+		s := string(bytes.TrimRight(b, "\x00"))
+		if s != "" && utf8.ValidString(s) {
+			return s, true
+		}
+	}
+
+	return "", false
+}
+
+func decodeDecimals(b []byte) (int, bool) {
+	if len(b) < 32 {
+		return 0, false
+	}
+	d := new(big.Int).SetBytes(b[:32])
+	if !d.IsUint64() || d.Uint64() > 255 {
+		return 0, false
+	}
+	return int(d.Uint64()), true
+}
+
+// GetMany reads the metadata of aa with one multicall per MetaBatch tokens,
+// falling back to single calls if the multicall fails. Tokens that could
+// not be read are nil.
+func GetMany(ctx context.Context, c *ethclient.Client, aa []common.Address) []*Token {
+	tt := make([]*Token, len(aa))
+
+	for i := 0; i < len(aa); i += MetaBatch {
+		j := i + MetaBatch
+		if j > len(aa) {
+			j = len(aa)
+		}
+
+		mm, err := multiMeta(ctx, c, aa[i:j])
+		if err != nil {
+			mm = make([]meta, j-i)
+			for k, a := range aa[i:j] {
+				mm[k] = singleMeta(ctx, c, a)
+			}
+		}
+
+		for k, m := range mm {
+			tt[i+k], _ = m.token(aa[i+k])
+		}
+	}
+
+	return tt
+}
+
+func multiMeta(ctx context.Context, c *ethclient.Client, aa []common.Address) ([]meta, error) {
+	calls := make([]mcCall, 0, 3*len(aa))
+	for _, a := range aa {
+		for _, sel := range [][]byte{selName, selSymbol, selDecimals} {
+			calls = append(calls, mcCall{Target: a, CallData: sel})
+		}
+	}
+
+	data, err := multicall.Pack("tryAggregate", false, calls)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.CallContract(ctx, ethereum.CallMsg{To: &MulticallAddress, Data: data}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "tl: multicall")
+	}
+
+	v, err := multicall.Unpack("tryAggregate", out)
+	if err != nil {
+		return nil, errors.Wrap(err, "tl: multicall: unpack")
+	}
+
+	res := *abi.ConvertType(v[0], new([]mcResult)).(*[]mcResult)
+	if len(res) != len(calls) {
+		return nil, errors.Errorf("tl: multicall: %d results for %d calls", len(res), len(calls))
+	}
+
+	mm := make([]meta, len(aa))
+	for i, r := range res {
+		if r.Success {
+			mm[i/3][i%3] = r.ReturnData
+		}
+	}
+
+	return mm, nil
+}
+
+func singleMeta(ctx context.Context, c *ethclient.Client, a common.Address) meta {
+	var m meta
+	for i, sel := range [][]byte{selName, selSymbol, selDecimals} {
+		if out, err := c.CallContract(ctx, ethereum.CallMsg{To: &a, Data: sel}, nil); err == nil {
+			m[i] = out
+		}
+	}
+	return m
+}
@@ -0,0 +1,325 @@
+package tokens
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// asm assembles the probe contract. Jump targets are labels resolved when
+// the code is taken.
+type asm struct {
+	code   []byte
+	labels map[string]int
+	refs   map[int]string
+	n      int
+}
+
+func newAsm() *asm {
+	return &asm{labels: make(map[string]int), refs: make(map[int]string)}
+}
+
+func (a *asm) op(ops ...vm.OpCode) {
+	for _, o := range ops {
+		a.code = append(a.code, byte(o))
+	}
+}
+
+func (a *asm) push(v *big.Int) {
+	b := v.Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	a.code = append(a.code, byte(vm.PUSH1)+byte(len(b)-1))
+	a.code = append(a.code, b...)
+}
+
+func (a *asm) pushN(n uint64) {
+	a.push(new(big.Int).SetUint64(n))
+}
+
+func (a *asm) pushAddr(x common.Address) {
+	a.op(vm.PUSH20)
+	a.code = append(a.code, x.Bytes()...)
+}
+
+func (a *asm) pushLabel(l string) {
+	a.op(vm.PUSH2)
+	a.refs[len(a.code)] = l
+	a.code = append(a.code, 0, 0)
+}
+
+func (a *asm) label(l string) {
+	a.labels[l] = len(a.code)
+	a.op(vm.JUMPDEST)
+}
+
+// jumpi jumps to l if the top of the stack is non zero.
+func (a *asm) jumpi(l string) {
+	a.pushLabel(l)
+	a.op(vm.JUMPI)
+}
+
+func (a *asm) unique(prefix string) string {
+	a.n++
+	return fmt.Sprintf("%s%d", prefix, a.n)
+}
+
+func (a *asm) mstore(off uint64) {
+	a.pushN(off)
+	a.op(vm.MSTORE)
+}
+
+func (a *asm) mload(off uint64) {
+	a.pushN(off)
+	a.op(vm.MLOAD)
+}
+
+func (a *asm) bytes() []byte {
+	for at, l := range a.refs {
+		binary.BigEndian.PutUint16(a.code[at:], uint16(a.labels[l]))
+	}
+	return a.code
+}
+
+// probe memory: calldata is built at 0, calls return into probeOut and the
+// measurements are kept from probeRes on, one word each.
+const (
+	probeOut = 0x100
+	probeRes = 0x200
+)
+
+// words of the probe's return data
+const (
+	resStage = iota
+	resBought
+	resSent
+	resReceived
+	resKept
+	resSold
+	resWETHOut
+	resWETHQuote
+	resReserveToken
+	resReserveWETH
+	resScratch
+
+	resWords
+)
+
+// probe stages, the last one entered is returned in resStage when a call
+// fails, 0 when all went through
+const (
+	stageDeposit = iota + 1
+	stagePayWETH
+	stageBuy
+	stageBought
+	stageTransfer
+	stageReceived
+	stageKept
+	stageSell
+	stageReserves
+	stageSold
+	stageSwapBack
+	stageWETHOut
+)
+
+var (
+	selDeposit     = selector("deposit()")
+	selTransfer    = selector("transfer(address,uint256)")
+	selBalanceOf   = selector("balanceOf(address)")
+	selSwap        = selector("swap(uint256,uint256,address,bytes)")
+	selGetReserves = selector("getReserves()")
+	selPaused      = selector("paused()")
+)
+
+func selector(sig string) []byte {
+	return crypto.Keccak256([]byte(sig))[:4]
+}
+
+// arg is a call argument: a constant, a result word or the probe's address.
+type arg func(a *asm)
+
+func argN(v *big.Int) arg {
+	return func(a *asm) { a.push(v) }
+}
+
+func argAddr(x common.Address) arg {
+	return func(a *asm) { a.pushAddr(x) }
+}
+
+func argRes(w uint64) arg {
+	return func(a *asm) { a.load(w) }
+}
+
+func argSelf() arg {
+	return func(a *asm) { a.op(vm.ADDRESS) }
+}
+
+func zero() arg {
+	return argN(new(big.Int))
+}
+
+func (a *asm) stage(s uint64) {
+	a.pushN(s)
+	a.store(resStage)
+}
+
+func (a *asm) store(w uint64) {
+	a.mstore(probeRes + 32*w)
+}
+
+func (a *asm) load(w uint64) {
+	a.mload(probeRes + 32*w)
+}
+
+func (a *asm) loadOut(w uint64) {
+	a.mload(probeOut + 32*w)
+}
+
+// call calls to with sel and args, returning outWords words into probeOut.
+// A failed call ends the probe.
+func (a *asm) call(to common.Address, value *big.Int, sel []byte, outWords uint64, args ...arg) {
+	a.push(new(big.Int).Lsh(new(big.Int).SetBytes(sel), 224))
+	a.mstore(0)
+	for i, ar := range args {
+		ar(a)
+		a.mstore(4 + 32*uint64(i))
+	}
+
+	a.pushN(32 * outWords)
+	a.pushN(probeOut)
+	a.pushN(4 + 32*uint64(len(args)))
+	a.pushN(0)
+	if value == nil {
+		value = new(big.Int)
+	}
+	a.push(value)
+	a.pushAddr(to)
+	a.op(vm.GAS, vm.CALL, vm.ISZERO)
+	a.jumpi("end")
+}
+
+// transfer is call for methods returning a bool; tokens that return false
+// instead of reverting end the probe as well.
+func (a *asm) transfer(to common.Address, sel []byte, args ...arg) {
+	a.call(to, nil, sel, 1, args...)
+
+	ok := a.unique("ok")
+	a.op(vm.RETURNDATASIZE, vm.ISZERO)
+	a.jumpi(ok)
+	a.loadOut(0)
+	a.op(vm.ISZERO)
+	a.jumpi("end")
+	a.label(ok)
+}
+
+func (a *asm) balanceOf(token common.Address, who arg, w uint64) {
+	a.call(token, nil, selBalanceOf, 1, who)
+	a.loadOut(0)
+	a.store(w)
+}
+
+// swapArgs orders amount as the token or the WETH out of pair.
+func swapArgs(amount arg, tokenOut, tokenIs0 bool) (arg, arg) {
+	if tokenOut == tokenIs0 {
+		return amount, zero()
+	}
+	return zero(), amount
+}
+
+type probeParams struct {
+	weth, token, pair, recv common.Address
+
+	tokenIs0 bool
+	amount   *big.Int // WETH spent on the buy
+	quote    *big.Int // token out of the buy as quoted by the router
+}
+
+// probeCode returns the code of a contract that, holding amount in ether,
+// buys token from pair, moves half of it to recv and sells the rest back,
+// measuring every step. It is only ever run by eth_call.
+func probeCode(p *probeParams) []byte {
+	a := newAsm()
+
+	a.stage(stageDeposit)
+	a.call(p.weth, p.amount, selDeposit, 0)
+
+	a.stage(stagePayWETH)
+	a.transfer(p.weth, selTransfer, argAddr(p.pair), argN(p.amount))
+
+	a.stage(stageBuy)
+	a0, a1 := swapArgs(argN(p.quote), true, p.tokenIs0)
+	a.call(p.pair, nil, selSwap, 0, a0, a1, argSelf(), argN(big.NewInt(0x80)), zero())
+
+	a.stage(stageBought)
+	a.balanceOf(p.token, argSelf(), resBought)
+
+	a.stage(stageTransfer)
+	a.pushN(2)
+	a.load(resBought)
+	a.op(vm.DIV)
+	a.store(resSent)
+	a.transfer(p.token, selTransfer, argAddr(p.recv), argRes(resSent))
+
+	a.stage(stageReceived)
+	a.balanceOf(p.token, argAddr(p.recv), resReceived)
+
+	a.stage(stageKept)
+	a.balanceOf(p.token, argSelf(), resKept)
+
+	a.stage(stageSell)
+	a.transfer(p.token, selTransfer, argAddr(p.pair), argRes(resKept))
+
+	a.stage(stageReserves)
+	a.call(p.pair, nil, selGetReserves, 3)
+	rt, rw := uint64(1), uint64(0)
+	if p.tokenIs0 {
+		rt, rw = 0, 1
+	}
+	a.loadOut(rt)
+	a.store(resReserveToken)
+	a.loadOut(rw)
+	a.store(resReserveWETH)
+
+	// what the pair actually got, and the getAmountOut for it
+	a.stage(stageSold)
+	a.balanceOf(p.token, argAddr(p.pair), resSold)
+	a.load(resReserveToken)
+	a.load(resSold)
+	a.op(vm.SUB)
+	a.store(resSold)
+
+	a.pushN(997)
+	a.load(resSold)
+	a.op(vm.MUL)
+	a.store(resScratch)
+
+	a.load(resScratch)
+	a.pushN(1000)
+	a.load(resReserveToken)
+	a.op(vm.MUL, vm.ADD)
+	a.load(resReserveWETH)
+	a.load(resScratch)
+	a.op(vm.MUL, vm.DIV)
+	a.store(resWETHQuote)
+
+	a.stage(stageSwapBack)
+	a0, a1 = swapArgs(argRes(resWETHQuote), false, p.tokenIs0)
+	a.call(p.pair, nil, selSwap, 0, a0, a1, argSelf(), argN(big.NewInt(0x80)), zero())
+
+	a.stage(stageWETHOut)
+	a.balanceOf(p.weth, argSelf(), resWETHOut)
+
+	a.stage(0)
+
+	a.label("end")
+	a.pushN(32 * resWords)
+	a.pushN(probeRes)
+	a.op(vm.RETURN)
+
+	return a.bytes()
+}
@@ -0,0 +1,325 @@
+package tokens
+
+import (
+	"context"
+	"math/big"
+	"sort"
+
+	"github.com/0xnibbler/mev-q4-2020/contracts/uniswapv2"
+	"github.com/0xnibbler/mev-q4-2020/model"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ScanAmount is the WETH the scanner buys each token with.
+	ScanAmount = model.DefaultAMT.Int()
+
+	// MaxTax is the largest buy, transfer or sell tax a token can take and
+	// still be traded. Anything below it is rounding.
+	MaxTax = 0.001
+
+	// AllowUnknown lets tokens the scanner could not run on, e.g. without a
+	// WETH pair, through pair vetting.
+	AllowUnknown = true
+)
+
+type RiskFlag string
+
+const (
+	RiskTaxed           RiskFlag = "taxed"
+	RiskRebasing        RiskFlag = "rebasing"
+	RiskNonTransferable RiskFlag = "non_transferable"
+	RiskPausable        RiskFlag = "pausable"
+	RiskHoneypot        RiskFlag = "honeypot"
+	RiskUnknown         RiskFlag = "unknown"
+)
+
+// Risk is what the scanner found out about a token by trading it.
+type Risk struct {
+	Flags []RiskFlag `json:"flags,omitempty"`
+
+	BuyTax      float64 `json:"buy_tax"`
+	TransferTax float64 `json:"transfer_tax"`
+	SellTax     float64 `json:"sell_tax"`
+
+	Pair  common.Address `json:"pair"`
+	Block uint64         `json:"block"`
+	Error string         `json:"error,omitempty"`
+}
+
+func (r *Risk) Has(f RiskFlag) bool {
+	for _, g := range r.Flags {
+		if g == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Risk) flag(f RiskFlag) {
+	if !r.Has(f) {
+		r.Flags = append(r.Flags, f)
+		sort.Slice(r.Flags, func(i, j int) bool { return r.Flags[i] < r.Flags[j] })
+	}
+}
+
+// Safe reports whether the token can be traded. Pausable alone is allowed,
+// a token that is paused right now is flagged non transferable.
+func (r *Risk) Safe() bool {
+	if r == nil {
+		return AllowUnknown
+	}
+	for _, f := range r.Flags {
+		switch f {
+		case RiskPausable:
+		case RiskUnknown:
+			if !AllowUnknown {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Scanner trades tokens against their WETH pair inside eth_call. A probe
+// contract is put at an unused address with a state override, given ether,
+// and buys the token, sends half of it to another address and sells the
+// rest back. The amounts that actually moved are compared with the quotes.
+type Scanner struct {
+	c  *rpc.Client
+	ec *ethclient.Client
+
+	routers []*uniswapv2.UniswapV2Router02Caller
+
+	probe, recv common.Address
+}
+
+func NewScanner(c *rpc.Client) (*Scanner, error) {
+	s := &Scanner{
+		c:     c,
+		ec:    ethclient.NewClient(c),
+		probe: common.BytesToAddress(crypto.Keccak256([]byte("tokens.Scanner.probe"))),
+		recv:  common.BytesToAddress(crypto.Keccak256([]byte("tokens.Scanner.recv"))),
+	}
+
+	// both routers have the same abi
+	for _, a := range []common.Address{model.UniswapV2RouterAddress, model.SushiswapRouterAddress} {
+		r, err := uniswapv2.NewUniswapV2Router02Caller(a, s.ec)
+		if err != nil {
+			return nil, err
+		}
+		s.routers = append(s.routers, r)
+	}
+
+	return s, nil
+}
+
+// Scan classifies token a. An error means the scan could not be run, not
+// that the token is unsafe.
+func (s *Scanner) Scan(ctx context.Context, a common.Address) (*Risk, error) {
+	if a == model.WETHAddress {
+		return &Risk{}, nil
+	}
+
+	head, err := s.ec.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	block := head.Number
+
+	r := &Risk{Block: block.Uint64()}
+	co := &bind.CallOpts{Context: ctx, BlockNumber: block}
+
+	router, pair, err := s.wethPair(co, a)
+	if err != nil {
+		return nil, err
+	}
+	if router == nil {
+		r.flag(RiskUnknown)
+		r.Error = "no weth pair"
+		return r, nil
+	}
+	r.Pair = pair
+
+	p, err := uniswapv2.NewUniswapV2PairCaller(pair, s.ec)
+	if err != nil {
+		return nil, err
+	}
+
+	t0, err := p.Token0(co)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan: token0")
+	}
+
+	reserves, err := p.GetReserves(co)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan: getReserves")
+	}
+	reserve := reserves.Reserve1
+	if t0 == a {
+		reserve = reserves.Reserve0
+	}
+
+	// balances only move by transfers for a normal token, and every
+	// transfer out of the pair updates its reserves
+	bal, err := s.balanceOf(ctx, a, pair, block)
+	if err != nil {
+		return nil, err
+	}
+	surplus := new(big.Int).Sub(bal, reserve)
+	if surplus.Sign() < 0 {
+		r.flag(RiskRebasing)
+		surplus.SetUint64(0)
+	}
+
+	if paused, ok := s.paused(ctx, a, block); ok {
+		r.flag(RiskPausable)
+		if paused {
+			r.flag(RiskNonTransferable)
+		}
+	}
+
+	amts, err := router.GetAmountsOut(co, ScanAmount, []common.Address{model.WETHAddress, a})
+	if err != nil {
+		return nil, errors.Wrap(err, "scan: getAmountsOut")
+	}
+	quote := amts[1]
+	if quote.Sign() == 0 {
+		r.flag(RiskUnknown)
+		r.Error = "no liquidity"
+		return r, nil
+	}
+
+	code := probeCode(&probeParams{
+		weth:     model.WETHAddress,
+		token:    a,
+		pair:     pair,
+		recv:     s.recv,
+		tokenIs0: t0 == a,
+		amount:   ScanAmount,
+		quote:    quote,
+	})
+
+	out, err := gethclient.New(s.c).CallContract(ctx, ethereum.CallMsg{
+		To:  &s.probe,
+		Gas: 10000000,
+	}, block, &map[common.Address]gethclient.OverrideAccount{
+		s.probe: {Code: code, Balance: ScanAmount},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "scan: probe")
+	}
+	if len(out) != 32*resWords {
+		return nil, errors.Errorf("scan: probe returned %d bytes", len(out))
+	}
+
+	word := func(i int) *big.Int {
+		return new(big.Int).SetBytes(out[32*i : 32*i+32])
+	}
+
+	switch stage := word(resStage).Uint64(); stage {
+	case 0:
+	case stageBuy, stageTransfer:
+		r.flag(RiskNonTransferable)
+		return r, nil
+	case stageSell, stageSwapBack:
+		r.flag(RiskHoneypot)
+		return r, nil
+	default:
+		return nil, errors.Errorf("scan: probe failed at stage %d", stage)
+	}
+
+	r.BuyTax = tax(word(resBought), quote)
+	r.TransferTax = tax(word(resReceived), word(resSent))
+
+	// the pair's balance went down while we held the token
+	sold := word(resSold)
+	if sold.Bit(255) == 1 || sold.Cmp(surplus) < 0 {
+		r.flag(RiskRebasing)
+		return r, nil
+	}
+	r.SellTax = tax(sold.Sub(sold, surplus), word(resKept))
+
+	if word(resWETHOut).Cmp(word(resWETHQuote)) < 0 {
+		r.flag(RiskHoneypot)
+	}
+
+	// reflection tokens pay holders on every transfer
+	if kept := new(big.Int).Sub(word(resBought), word(resSent)); kept.Cmp(word(resKept)) != 0 {
+		r.flag(RiskRebasing)
+	}
+
+	if r.BuyTax > MaxTax || r.TransferTax > MaxTax || r.SellTax > MaxTax {
+		r.flag(RiskTaxed)
+	}
+
+	return r, nil
+}
+
+// wethPair finds the first router whose factory has a WETH pair for a.
+func (s *Scanner) wethPair(co *bind.CallOpts, a common.Address) (*uniswapv2.UniswapV2Router02Caller, common.Address, error) {
+	for _, r := range s.routers {
+		fa, err := r.Factory(co)
+		if err != nil {
+			return nil, common.Address{}, errors.Wrap(err, "scan: factory")
+		}
+
+		f, err := uniswapv2.NewUniswapV2FactoryCaller(fa, s.ec)
+		if err != nil {
+			return nil, common.Address{}, err
+		}
+
+		pair, err := f.GetPair(co, model.WETHAddress, a)
+		if err != nil {
+			return nil, common.Address{}, errors.Wrap(err, "scan: getPair")
+		}
+		if pair != (common.Address{}) {
+			return r, pair, nil
+		}
+	}
+
+	return nil, common.Address{}, nil
+}
+
+func (s *Scanner) balanceOf(ctx context.Context, token, who common.Address, block *big.Int) (*big.Int, error) {
+	out, err := s.ec.CallContract(ctx, ethereum.CallMsg{
+		To:   &token,
+		Data: append(append([]byte{}, selBalanceOf...), common.LeftPadBytes(who.Bytes(), 32)...),
+	}, block)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan: balanceOf")
+	}
+	if len(out) < 32 {
+		return nil, errors.New("scan: balanceOf: short return")
+	}
+	return new(big.Int).SetBytes(out[:32]), nil
+}
+
+// paused reports whether the token is paused, ok is false if it has no
+// paused() to call.
+func (s *Scanner) paused(ctx context.Context, token common.Address, block *big.Int) (paused, ok bool) {
+	out, err := s.ec.CallContract(ctx, ethereum.CallMsg{To: &token, Data: selPaused}, block)
+	if err != nil || len(out) != 32 {
+		return false, false
+	}
+	return new(big.Int).SetBytes(out).Sign() != 0, true
+}
+
+// tax is the share of want that did not arrive.
+func tax(got, want *big.Int) float64 {
+	if want.Sign() == 0 || got.Cmp(want) >= 0 {
+		return 0
+	}
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(new(big.Int).Sub(want, got)), new(big.Float).SetInt(want)).Float64()
+	return f
+}
@@ -0,0 +1,67 @@
+package tokens
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestTax(t *testing.T) {
+	for _, tc := range []struct {
+		got, want int64
+		tax       float64
+	}{
+		{1000, 1000, 0},
+		{1100, 1000, 0},
+		{990, 1000, 0.01},
+		{900, 1000, 0.1},
+		{0, 1000, 1},
+		{0, 0, 0},
+		{5, 0, 0},
+	} {
+		if got := tax(big.NewInt(tc.got), big.NewInt(tc.want)); got != tc.tax {
+			t.Errorf("tax(%d, %d) = %f, want %f", tc.got, tc.want, got, tc.tax)
+		}
+	}
+}
+
+func TestSafe(t *testing.T) {
+	defer func(a bool) { AllowUnknown = a }(AllowUnknown)
+
+	for _, tc := range []struct {
+		name    string
+		r       *Risk
+		unknown bool
+		safe    bool
+	}{
+		{"clean", &Risk{}, false, true},
+		{"pausable", &Risk{Flags: []RiskFlag{RiskPausable}}, false, true},
+		{"taxed", &Risk{Flags: []RiskFlag{RiskTaxed}}, true, false},
+		{"honeypot", &Risk{Flags: []RiskFlag{RiskHoneypot, RiskPausable}}, true, false},
+		{"rebasing", &Risk{Flags: []RiskFlag{RiskRebasing}}, true, false},
+		{"non transferable", &Risk{Flags: []RiskFlag{RiskNonTransferable}}, true, false},
+		{"unknown allowed", &Risk{Flags: []RiskFlag{RiskUnknown}}, true, true},
+		{"unknown refused", &Risk{Flags: []RiskFlag{RiskUnknown}}, false, false},
+		{"unknown and taxed", &Risk{Flags: []RiskFlag{RiskTaxed, RiskUnknown}}, true, false},
+		{"not scanned allowed", nil, true, true},
+		{"not scanned refused", nil, false, false},
+	} {
+		AllowUnknown = tc.unknown
+		if got := tc.r.Safe(); got != tc.safe {
+			t.Errorf("%s: safe %t", tc.name, got)
+		}
+	}
+}
+
+func TestFlag(t *testing.T) {
+	r := &Risk{}
+	r.flag(RiskTaxed)
+	r.flag(RiskHoneypot)
+	r.flag(RiskTaxed)
+
+	if len(r.Flags) != 2 || r.Flags[0] != RiskHoneypot || r.Flags[1] != RiskTaxed {
+		t.Errorf("flags %v, want sorted and unique", r.Flags)
+	}
+	if !r.Has(RiskTaxed) || r.Has(RiskRebasing) {
+		t.Errorf("Has on %v", r.Flags)
+	}
+}
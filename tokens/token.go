@@ -2,13 +2,11 @@ package tokens
 
 import (
 	"context"
-	"github.com/0xnibbler/mev-q4-2020/contracts/erc20"
+
 	"github.com/0xnibbler/mev-q4-2020/model"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/pkg/errors"
 )
 
 type Token struct {
@@ -17,42 +15,22 @@ type Token struct {
 	Symbol   string         `json:"symbol"`
 	Decimals int            `json:"decimals"`
 	ChainID  int            `json:"chain_id"`
+
+	// Inferred are the fields the token did not return and were filled in.
+	Inferred []string `json:"inferred,omitempty"`
+
+	// Tags come from imported token lists.
+	Tags []string `json:"tags,omitempty"`
+
+	Risk *Risk `json:"risk,omitempty"`
+	Code *Code `json:"code,omitempty"`
 }
 
 func (t *Token) IsWETH() bool {
 	return t.Address == model.WETHAddress
 }
 
+// Get reads the metadata of token a, see GetMany.
 func Get(ctx context.Context, c *ethclient.Client, a common.Address) (*Token, error) {
-	instance, err := erc20.NewTokenCaller(a, c)
-	if err != nil {
-		return nil, errors.Wrap(err, "tl: get: new instance:")
-	}
-
-	co := &bind.CallOpts{Context: ctx}
-
-	name, err := instance.Name(co)
-	if err != nil {
-		return nil, errors.Wrap(err, "tl: get: name:")
-	}
-
-	symbol, err := instance.Symbol(co)
-	if err != nil {
-		return nil, errors.Wrap(err, "tl: get: symbol:")
-	}
-
-	decimals, err := instance.Decimals(co)
-	if err != nil {
-		return nil, errors.Wrap(err, "tl: get: decimals:")
-	}
-
-	t := &Token{
-		Address:  a,
-		Symbol:   symbol,
-		Name:     name,
-		Decimals: int(decimals),
-		ChainID:  1,
-	}
-
-	return t, nil
+	return singleMeta(ctx, c, a).token(a)
 }
@@ -0,0 +1,232 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+var (
+	// AllowTags, when not empty, limits trading to tokens with one of these
+	// token list tags.
+	AllowTags []string
+
+	// DenyTags keeps tokens with any of these tags out, whatever AllowTags
+	// says.
+	DenyTags []string
+)
+
+// TokenList is the Uniswap token list format,
+// https://github.com/Uniswap/token-lists.
+type TokenList struct {
+	Name      string      `json:"name"`
+	Timestamp time.Time   `json:"timestamp"`
+	Version   ListVersion `json:"version"`
+	Tokens    []ListToken `json:"tokens"`
+	Keywords  []string    `json:"keywords,omitempty"`
+	Tags      ListTags    `json:"tags,omitempty"`
+	LogoURI   string      `json:"logoURI,omitempty"`
+}
+
+type ListVersion struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+}
+
+type ListTags map[string]struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type ListToken struct {
+	ChainID  int      `json:"chainId"`
+	Address  string   `json:"address"`
+	Name     string   `json:"name"`
+	Symbol   string   `json:"symbol"`
+	Decimals int      `json:"decimals"`
+	LogoURI  string   `json:"logoURI,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// ReadTokenList reads a token list from a file or an http(s) url.
+func ReadTokenList(src string) (*TokenList, error) {
+	var r io.ReadCloser
+
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := http.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("token list %s: %s", src, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	tl := &TokenList{}
+	if err := json.NewDecoder(r).Decode(tl); err != nil {
+		return nil, errors.Wrap(err, "token list "+src)
+	}
+
+	return tl, nil
+}
+
+func (tl *TokenList) Write(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(tl)
+}
+
+// Merge combines lists in order of precedence: a token's name, symbol and
+// decimals come from the first list that has it, its tags from all of them.
+// Tokens of other chains than chainID are left out, addresses come back
+// checksummed.
+func Merge(chainID int, lists ...*TokenList) []ListToken {
+	var out []ListToken
+	idx := make(map[common.Address]int)
+
+	for _, tl := range lists {
+		for _, t := range tl.Tokens {
+			if t.ChainID != chainID || !common.IsHexAddress(t.Address) {
+				continue
+			}
+			a := common.HexToAddress(t.Address)
+			t.Address = a.Hex()
+
+			i, ok := idx[a]
+			if !ok {
+				idx[a] = len(out)
+				t.Tags = append([]string(nil), t.Tags...)
+				out = append(out, t)
+				continue
+			}
+
+			out[i].Tags = union(out[i].Tags, t.Tags)
+		}
+	}
+
+	return out
+}
+
+func union(a, b []string) []string {
+	for _, s := range b {
+		if !contains(a, s) {
+			a = append(a, s)
+		}
+	}
+	return a
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Import merges lists, see Merge, into l. Listed metadata replaces what was
+// read from chain and the tags replace the ones from earlier imports. It
+// returns how many tokens were new.
+func (l *List) Import(lists ...*TokenList) int {
+	var added int
+
+	l.tokensLock.Lock()
+	for _, lt := range Merge(1, lists...) {
+		a := common.HexToAddress(lt.Address)
+		t := l.tokens[a]
+		if t == nil {
+			t = &Token{Address: a}
+			l.tokens[a] = t
+			added++
+		}
+
+		t.Name = lt.Name
+		t.Symbol = lt.Symbol
+		t.Decimals = lt.Decimals
+		t.ChainID = lt.ChainID
+		t.Tags = lt.Tags
+		t.Inferred = nil
+	}
+	l.tokensLock.Unlock()
+
+	return added
+}
+
+// Export returns l as a token list.
+func (l *List) Export(name string, version ListVersion) *TokenList {
+	tl := &TokenList{
+		Name:      name,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Version:   version,
+	}
+
+	l.tokensLock.RLock()
+	for _, t := range l.tokens {
+		chainID := t.ChainID
+		if chainID == 0 {
+			chainID = 1
+		}
+
+		// the schema's length limits
+		tl.Tokens = append(tl.Tokens, ListToken{
+			ChainID:  chainID,
+			Address:  t.Address.Hex(),
+			Name:     truncate(t.Name, 40),
+			Symbol:   truncate(t.Symbol, 20),
+			Decimals: t.Decimals,
+			Tags:     t.Tags,
+		})
+	}
+	l.tokensLock.RUnlock()
+
+	sort.Slice(tl.Tokens, func(i, j int) bool {
+		return strings.ToLower(tl.Tokens[i].Address) < strings.ToLower(tl.Tokens[j].Address)
+	})
+
+	return tl
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// TagsAllowed checks t's tags against AllowTags and DenyTags.
+func (t *Token) TagsAllowed() bool {
+	for _, tag := range t.Tags {
+		if contains(DenyTags, tag) {
+			return false
+		}
+	}
+
+	if len(AllowTags) == 0 {
+		return true
+	}
+	for _, tag := range t.Tags {
+		if contains(AllowTags, tag) {
+			return true
+		}
+	}
+	return false
+}
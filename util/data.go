@@ -41,3 +41,15 @@ func Load(file string, data interface{}) error {
 	defer f.Close()
 	return json.NewDecoder(f).Decode(data)
 }
+
+func Path(file string) string {
+	return path.Join(dataDir, file)
+}
+
+func OpenAppend(file string) (*os.File, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(Path(file), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
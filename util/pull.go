@@ -14,6 +14,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type router interface {
@@ -29,7 +30,7 @@ type poolPuller interface {
 var uniV2RouterAddress = common.HexToAddress("0x7a250d5630B4cF539739dF2C5dAcb4c659F2488D")
 var sushiRouterAddress = common.HexToAddress("0xd9e1cE17f2641f24aE83637ab66a2cca9C378B9F")
 
-func PullAll(ctx context.Context, c *ethclient.Client, list *tokens.List, u2, su poolPuller) error {
+func PullAll(ctx context.Context, c *ethclient.Client, list *tokens.List, scanner *tokens.Scanner, u2, su poolPuller, log logrus.FieldLogger) error {
 	pp, err := u2.GetAllPools(ctx, 0)
 	if err != nil {
 		return errors.Wrap(err, "crv: GetAllPools")
@@ -42,7 +43,7 @@ func PullAll(ctx context.Context, c *ethclient.Client, list *tokens.List, u2, su
 
 	tt0, tt1, err := getTokens(ctx, list, pp)
 
-	testLiqAll(ctx, routerU2, pp, tt0, tt1, u2)
+	testLiqAll(ctx, routerU2, list, scanner, pp, tt0, tt1, u2, log)
 
 	if err := u2.Save(); err != nil {
 		return err
@@ -60,7 +61,7 @@ func PullAll(ctx context.Context, c *ethclient.Client, list *tokens.List, u2, su
 
 	tt0, tt1, err = getTokens(ctx, list, pp)
 
-	testLiqAll(ctx, routerSu, pp, tt0, tt1, su)
+	testLiqAll(ctx, routerSu, list, scanner, pp, tt0, tt1, su, log)
 
 	if err := su.Save(); err != nil {
 		return err
@@ -76,28 +77,23 @@ func PullAll(ctx context.Context, c *ethclient.Client, list *tokens.List, u2, su
 func getTokens(ctx context.Context, list *tokens.List, pools []*model.PoolsResp) (tt0, tt1 []*tokens.Token, err error) {
 	tt0 = make([]*tokens.Token, len(pools))
 	tt1 = make([]*tokens.Token, len(pools))
+
+	aa := make([]common.Address, 0, 2*len(pools))
+	for _, p := range pools {
+		aa = append(aa, p.T0, p.T1)
+	}
+
+	if failed := list.AddMany(ctx, aa); len(failed) > 0 {
+		fmt.Println("tokens: no metadata for", len(failed))
+	}
+
 	var total, success int
-outer:
 	for i, p := range pools {
 		total++
-		for j, a := range []common.Address{p.T0, p.T1} {
-			if list.ByAddr(a) == nil {
-				err := list.Add(ctx, a)
-				if err != nil {
-					continue outer
-				}
-			}
-
-			t := list.ByAddr(a)
-			if t == nil {
-				continue outer
-			}
-
-			if j == 0 {
-				tt0[i] = t
-			} else {
-				tt1[i] = t
-			}
+
+		tt0[i], tt1[i] = list.ByAddr(p.T0), list.ByAddr(p.T1)
+		if tt0[i] == nil || tt1[i] == nil {
+			continue
 		}
 		success++
 	}
@@ -107,8 +103,8 @@ outer:
 	return
 }
 
-func testLiqAll(ctx context.Context, router router, pp []*model.PoolsResp, tt0, tt1 []*tokens.Token, am poolPuller) {
-	var success int
+func testLiqAll(ctx context.Context, router router, list *tokens.List, scanner *tokens.Scanner, pp []*model.PoolsResp, tt0, tt1 []*tokens.Token, am poolPuller, log logrus.FieldLogger) {
+	var success, unsafe int
 	for i, p := range pp {
 		t0, t1 := tt0[i], tt1[i]
 
@@ -116,6 +112,11 @@ func testLiqAll(ctx context.Context, router router, pp []*model.PoolsResp, tt0,
 			continue
 		}
 
+		if !safe(ctx, list, scanner, t0, log) || !safe(ctx, list, scanner, t1, log) {
+			unsafe++
+			continue
+		}
+
 		f, err := testLiq(ctx, router, t0.Address, t1.Address)
 		if err != nil || f < 0.9 {
 			continue
@@ -125,8 +126,30 @@ func testLiqAll(ctx context.Context, router router, pp []*model.PoolsResp, tt0,
 		am.AddPair(p.A, tt0[i], tt1[i])
 	}
 
-	fmt.Println("test liq", success, len(pp))
+	fmt.Println("test liq", success, len(pp), "unsafe", unsafe)
+
+}
+
+// safe checks t's tags and scans it if it has not been yet. Tokens the
+// scan could not run on are let through as tokens.AllowUnknown says.
+func safe(ctx context.Context, list *tokens.List, scanner *tokens.Scanner, t *tokens.Token, log logrus.FieldLogger) bool {
+	if tokens.TrustedTokens[t.Address] {
+		return true
+	}
+	if !t.TagsAllowed() {
+		return false
+	}
+	if scanner == nil {
+		return true
+	}
+
+	r, err := list.Scan(ctx, scanner, t.Address)
+	if err != nil {
+		log.WithError(err).WithField("token", t.Address.Hex()).Warnln("scan failed, allowed:", tokens.AllowUnknown)
+		return tokens.AllowUnknown
+	}
 
+	return r.Safe()
 }
 
 func testLiq(ctx context.Context, router router, from, to common.Address) (float64, error) {